@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	"whapp-irc/ircconnection"
+	"whapp-irc/types"
+	"whapp-irc/whapp"
+)
+
+// ackNames are the names of the acknowledgement states shown on IRC.
+var ackNames = map[int]string{
+	whapp.AckError:     "failed",
+	whapp.AckSent:      "sent",
+	whapp.AckDelivered: "delivered",
+	whapp.AckRead:      "read",
+	whapp.AckPlayed:    "played",
+}
+
+// deliverAck tracks the given change in the acknowledgement state of a message
+// and sends it to the attached clients, if it's about a message sent by the
+// user. Like reactions, acks aren't kept while no client is attached.
+func (conn *Connection) deliverAck(ack whapp.Ack) error {
+	if !ack.ID.FromMe {
+		return nil
+	}
+	name, has := ackNames[ack.Ack]
+	if !has {
+		return nil
+	}
+
+	// WhatsApp Web reports the same state multiple times, and the states of
+	// a message only go up, except when sending failed.
+	msg, found := conn.messages.Get(ack.ID.Serialized)
+	if !found || ack.Ack == msg.Ack || (ack.Ack < msg.Ack && ack.Ack != whapp.AckError) {
+		return nil
+	}
+	msg.Ack = ack.Ack
+	conn.messages.Add(msg)
+
+	item, has := conn.Chats.ByID(msg.Chat.ID, false)
+	if !has {
+		return nil
+	}
+
+	clients := conn.clientList()
+	if len(clients) == 0 {
+		return nil
+	}
+	return conn.handleWhappAck(clients, item, msg, name)
+}
+
+// handleWhappAck sends the new acknowledgement state, with the given name, of
+// the given message to the given clients, as configured for its chat.
+func (conn *Connection) handleWhappAck(
+	clients []*ircconnection.Connection,
+	item types.ChatListItem,
+	msg whapp.Message,
+	name string,
+) error {
+	switch item.Settings.EffectiveReceipts() {
+	case types.ReceiptsNotices:
+		body := getMessageBody(msg, item.Chat.Participants, conn.me)
+		str := fmt.Sprintf(
+			"%s: message %q %s",
+			item.Identifier,
+			messageSnippet(body),
+			name,
+		)
+		return eachClient(clients, func(irc *ircconnection.Connection) error {
+			return irc.WriteNow(fmt.Sprintf(":status NOTICE %s :%s", irc.Nick(), str))
+		})
+
+	case types.ReceiptsTags:
+		tags := ircconnection.Tags{
+			"whapp-irc/ack":       name,
+			"whapp-irc/ack-msgid": msgID(&msg, 0),
+		}
+		return eachClient(clients, func(irc *ircconnection.Connection) error {
+			return irc.TagMessage(time.Now(), tags, conn.nick, item.Identifier)
+		})
+	}
+
+	return nil
+}
@@ -2,35 +2,725 @@ package bridge
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"sync"
 	"time"
 	"whapp-irc/whapp"
 
 	"github.com/chromedp/chromedp"
 )
 
+const (
+	// maxRecoveryAttempts is the amount of times we try to recover a lost
+	// WhatsApp Web session before giving up.
+	maxRecoveryAttempts = 5
+	// recoveryTimeout is the maximum duration of a single recovery attempt.
+	recoveryTimeout = 90 * time.Second
+)
+
+// Hooks are used by a Bridge to communicate with its user while recovering.
+type Hooks struct {
+	// Status is called with human readable progress updates.
+	Status func(msg string)
+	// LocalStorage returns the stored WhatsApp Web session, which is restored
+	// when chromium has to be relaunched.
+	LocalStorage func() (map[string]string, error)
+}
+
+// Instance is a WhatsApp Web session supervised by a Bridge, *whapp.Instance is
+// the default implementation.
+type Instance interface {
+	whapp.Backend
+
+	// Resets receives a value when the state of the instance has been lost.
+	Resets() <-chan whapp.ResetReason
+	// LoggedIn returns whether or not the user was logged in the last time
+	// the login state has been checked.
+	LoggedIn() bool
+}
+
+// generation is a single instance used by the bridge, it's replaced when the
+// instance is recovered.
+type generation struct {
+	wi       Instance
+	replaced chan struct{}
+}
+
+// A Bridge is a whapp.Backend supervising a chromium instance. When chromium
+// crashes or WhatsApp Web reloads, the Bridge relaunches or re-navigates the
+// instance, restores the session and resumes the listeners.
+type Bridge struct {
+	ctx    context.Context
+	launch func() (Instance, error)
+	hooks  Hooks
+
+	recoverMu sync.Mutex // held while recovering
+	failed    error      // why recovering failed for good, protected by recoverMu
+
+	mu  sync.RWMutex
+	gen *generation
+}
+
 // Start creates and starts a bridge
 func Start(
 	ctx context.Context,
 	pool *chromedp.Pool,
 	loggingLevel whapp.LoggingLevel,
-) (bridge *whapp.Instance, err error) {
-	wi, err := whapp.MakeInstanceWithPool(ctx, pool, true, loggingLevel)
+	hooks Hooks,
+) (bridge *Bridge, err error) {
+	return start(ctx, func() (Instance, error) {
+		wi, err := whapp.MakeInstanceWithPool(ctx, pool, true, loggingLevel)
+		if err != nil {
+			return nil, err
+		}
+		return wi, nil
+	}, hooks)
+}
+
+// start creates and starts a bridge, using launch to launch new instances.
+func start(ctx context.Context, launch func() (Instance, error), hooks Hooks) (*Bridge, error) {
+	wi, err := launch()
 	if err != nil {
 		return nil, err
 	}
 
+	b := &Bridge{
+		ctx:    ctx,
+		launch: launch,
+		hooks:  hooks,
+
+		gen: &generation{
+			wi:       wi,
+			replaced: make(chan struct{}),
+		},
+	}
+
 	// when the context is cancelled, stop the bridge
 	go func() {
 		<-ctx.Done()
 
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		if err := wi.Shutdown(ctx); err != nil {
+		if err := b.current().wi.Shutdown(ctx); err != nil {
 			log.Printf("error while shutting down: %s", err)
 		}
 
 		cancel()
 	}()
 
+	go b.watch()
+
+	return b, nil
+}
+
+func (b *Bridge) current() *generation {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.gen
+}
+
+func (b *Bridge) status(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Println(msg)
+	if b.hooks.Status != nil {
+		b.hooks.Status(msg)
+	}
+}
+
+// watch recovers the current instance whenever it reports that its state has
+// been lost.
+func (b *Bridge) watch() {
+	for {
+		gen := b.current()
+
+		select {
+		case <-b.ctx.Done():
+			return
+
+		case <-gen.replaced:
+			continue
+
+		case reason := <-gen.wi.Resets():
+			if !gen.wi.LoggedIn() {
+				// we haven't logged in yet, setup handles this itself.
+				continue
+			}
+
+			if err := b.recover(gen, reason); err != nil {
+				log.Printf("error while recovering: %s", err)
+			}
+		}
+	}
+}
+
+// recover recovers the instance of the given generation, unless it has already
+// been replaced. When the session turns out to be logged out on the phone
+// whapp.ErrLoggedOut is returned right away, since retrying won't help.
+func (b *Bridge) recover(gen *generation, reason whapp.ResetReason) error {
+	b.recoverMu.Lock()
+	defer b.recoverMu.Unlock()
+
+	if b.failed != nil {
+		return b.failed
+	} else if b.current() != gen {
+		return nil // already recovered
+	}
+
+	b.status("lost WhatsApp Web session (%s), recovering", reason)
+
+	relaunch := reason == whapp.ResetCrash
+	wi := gen.wi
+	var err error
+	for attempt := 1; attempt <= maxRecoveryAttempts; attempt++ {
+		// the instance of a failed attempt is passed to the next one, which
+		// shuts it down when relaunching.
+		var next Instance
+		next, err = b.restore(wi, relaunch)
+		if next != nil {
+			wi = next
+		}
+
+		if err == nil {
+			b.mu.Lock()
+			b.gen = &generation{
+				wi:       wi,
+				replaced: make(chan struct{}),
+			}
+			close(gen.replaced)
+			b.mu.Unlock()
+
+			b.status("recovered WhatsApp Web session")
+			return nil
+		} else if err == whapp.ErrLoggedOut {
+			b.shutdown(gen, wi)
+			b.failed = err
+			return err
+		}
+
+		b.status("recovery attempt %d failed: %s", attempt, err)
+
+		// maybe re-navigating wasn't enough, so start from scratch the next
+		// time.
+		relaunch = true
+
+		select {
+		case <-b.ctx.Done():
+			b.shutdown(gen, wi)
+			return b.ctx.Err()
+		case <-time.After(time.Duration(attempt) * 2 * time.Second):
+		}
+	}
+
+	b.shutdown(gen, wi)
+	b.failed = fmt.Errorf("giving up recovering after %d attempts: %s", maxRecoveryAttempts, err)
+	return b.failed
+}
+
+// shutdown shuts down the given instance of a failed recovery of gen, unless
+// it's the instance of gen itself.
+func (b *Bridge) shutdown(gen *generation, wi Instance) {
+	if wi == gen.wi {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := wi.Shutdown(ctx); err != nil {
+		log.Printf("error while shutting down failed instance: %s", err)
+	}
+}
+
+// restore re-navigates the given instance, or relaunches a new one if relaunch
+// is true, restoring the session stored in the database.
+func (b *Bridge) restore(wi Instance, relaunch bool) (Instance, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, recoveryTimeout)
+	defer cancel()
+
+	if relaunch {
+		shutdownCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		if err := wi.Shutdown(shutdownCtx); err != nil {
+			log.Printf("error while shutting down old instance: %s", err)
+		}
+		cancel()
+
+		b.status("relaunching chromium")
+
+		var err error
+		wi, err = b.launch()
+		if err != nil {
+			return nil, err
+		}
+
+		if b.hooks.LocalStorage != nil {
+			localStorage, err := b.hooks.LocalStorage()
+			if err != nil {
+				return wi, err
+			}
+
+			if err := wi.Navigate(ctx); err != nil {
+				return wi, err
+			}
+			if err := wi.SetLocalStorage(ctx, localStorage); err != nil {
+				return wi, err
+			}
+		}
+	}
+
+	b.status("opening WhatsApp Web")
+	state, err := wi.Open(ctx)
+	if err != nil {
+		return wi, err
+	} else if state != whapp.Loggedin {
+		return wi, whapp.ErrLoggedOut
+	}
+
+	// inject and make sure everything works
+	if _, err := wi.GetMe(ctx); err != nil {
+		return wi, err
+	}
+
 	return wi, nil
 }
+
+// resume calls listen with the instance of the current generation, and again
+// with the recovered instance whenever listen fails or the instance has been
+// replaced, until ctx is done. The ctx passed to listen is done when its
+// instance has been replaced, listen should return then. ErrNoPush,
+// ErrLoggedOut and errors the bridge can't recover from are returned.
+func (b *Bridge) resume(ctx context.Context, listen func(ctx context.Context, wi Instance) error) error {
+	for {
+		gen := b.current()
+
+		listenCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-gen.replaced:
+				cancel()
+			case <-listenCtx.Done():
+			}
+		}()
+		err := listen(listenCtx, gen.wi)
+		cancel()
+
+		if ctx.Err() != nil {
+			return nil
+		} else if err == whapp.ErrNoPush || err == whapp.ErrLoggedOut {
+			return err
+		} else if err != nil {
+			if err := b.recover(gen, whapp.ResetReload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ListenLoggedIn implements whapp.Backend, resuming listening on the recovered
+// instance when needed.
+func (b *Bridge) ListenLoggedIn(ctx context.Context, interval time.Duration) (<-chan bool, <-chan error) {
+	errCh := make(chan error)
+	resCh := make(chan bool)
+
+	go func() {
+		defer close(errCh)
+		defer close(resCh)
+
+		if err := b.resume(ctx, func(ctx context.Context, wi Instance) error {
+			ch, listenErrCh := wi.ListenLoggedIn(ctx, interval)
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case err := <-listenErrCh:
+					return err
+
+				case res, ok := <-ch:
+					if !ok {
+						return nil
+					}
+					select {
+					case <-ctx.Done():
+						return nil
+					case resCh <- res:
+					}
+				}
+			}
+		}); err != nil {
+			errCh <- err
+		}
+	}()
+
+	return resCh, errCh
+}
+
+// ListenForMessages implements whapp.Backend, resuming listening on the
+// recovered instance when needed. Messages received while recovering are
+// fetched and sent after the recovery has finished.
+func (b *Bridge) ListenForMessages(ctx context.Context, interval time.Duration) (<-chan whapp.Message, <-chan error) {
+	errCh := make(chan error)
+	messageCh := make(chan whapp.Message)
+
+	go func() {
+		defer close(errCh)
+		defer close(messageCh)
+
+		since := time.Now().Unix()
+		positions := make(map[whapp.ID]*chatPosition)
+
+		// forward sends the given message, unless it's the same as the newest
+		// message already sent in its chat.
+		forward := func(ctx context.Context, msg whapp.Message) {
+			pos := positions[msg.Chat.ID]
+			if pos != nil && msg.Timestamp == pos.timestamp && pos.ids[msg.ID.Serialized] {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				// the message will be fetched again after recovering.
+				return
+			case messageCh <- msg:
+			}
+
+			if pos == nil || msg.Timestamp > pos.timestamp {
+				pos = &chatPosition{
+					timestamp: msg.Timestamp,
+					ids:       make(map[string]bool),
+				}
+				positions[msg.Chat.ID] = pos
+			}
+			if msg.Timestamp == pos.timestamp {
+				pos.ids[msg.ID.Serialized] = true
+			}
+		}
+
+		resumed := false
+		if err := b.resume(ctx, func(ctx context.Context, wi Instance) error {
+			ch, listenErrCh := wi.ListenForMessages(ctx, interval)
+
+			// catch up with the messages we missed while recovering
+			if resumed {
+				missed, err := missedMessages(ctx, wi, since, positions)
+				if err != nil {
+					log.Printf("error while fetching missed messages: %s", err)
+				}
+				for _, msg := range missed {
+					forward(ctx, msg)
+				}
+			}
+			resumed = true
+
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case err := <-listenErrCh:
+					return err
+
+				case msg, ok := <-ch:
+					if !ok {
+						return nil
+					}
+					forward(ctx, msg)
+				}
+			}
+		}); err != nil {
+			errCh <- err
+		}
+	}()
+
+	return messageCh, errCh
+}
+
+// ListenForAcks implements whapp.Backend, resuming listening on the
+// recovered instance when needed. Acks received while recovering are lost.
+func (b *Bridge) ListenForAcks(ctx context.Context) (<-chan whapp.Ack, <-chan error) {
+	errCh := make(chan error)
+	resCh := make(chan whapp.Ack)
+
+	go func() {
+		defer close(errCh)
+		defer close(resCh)
+
+		if err := b.resume(ctx, func(ctx context.Context, wi Instance) error {
+			ch, listenErrCh := wi.ListenForAcks(ctx)
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case err := <-listenErrCh:
+					return err
+
+				case res, ok := <-ch:
+					if !ok {
+						return nil
+					}
+					select {
+					case <-ctx.Done():
+						return nil
+					case resCh <- res:
+					}
+				}
+			}
+		}); err != nil {
+			errCh <- err
+		}
+	}()
+
+	return resCh, errCh
+}
+
+// ListenForReactions implements whapp.Backend, resuming listening on the
+// recovered instance when needed. Reactions received while recovering are lost.
+func (b *Bridge) ListenForReactions(ctx context.Context) (<-chan whapp.Reaction, <-chan error) {
+	errCh := make(chan error)
+	resCh := make(chan whapp.Reaction)
+
+	go func() {
+		defer close(errCh)
+		defer close(resCh)
+
+		if err := b.resume(ctx, func(ctx context.Context, wi Instance) error {
+			ch, listenErrCh := wi.ListenForReactions(ctx)
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case err := <-listenErrCh:
+					return err
+
+				case res, ok := <-ch:
+					if !ok {
+						return nil
+					}
+					select {
+					case <-ctx.Done():
+						return nil
+					case resCh <- res:
+					}
+				}
+			}
+		}); err != nil {
+			errCh <- err
+		}
+	}()
+
+	return resCh, errCh
+}
+
+// ListenForChatStates implements whapp.Backend, resuming listening on the
+// recovered instance when needed. Chat states received while recovering are
+// lost.
+func (b *Bridge) ListenForChatStates(ctx context.Context) (<-chan whapp.ChatState, <-chan error) {
+	errCh := make(chan error)
+	resCh := make(chan whapp.ChatState)
+
+	go func() {
+		defer close(errCh)
+		defer close(resCh)
+
+		if err := b.resume(ctx, func(ctx context.Context, wi Instance) error {
+			ch, listenErrCh := wi.ListenForChatStates(ctx)
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case err := <-listenErrCh:
+					return err
+
+				case res, ok := <-ch:
+					if !ok {
+						return nil
+					}
+					select {
+					case <-ctx.Done():
+						return nil
+					case resCh <- res:
+					}
+				}
+			}
+		}); err != nil {
+			errCh <- err
+		}
+	}()
+
+	return resCh, errCh
+}
+
+// chatPosition is the position of the newest messages sent by the bridge in a
+// chat.
+type chatPosition struct {
+	timestamp int64
+	ids       map[string]bool // IDs of the sent messages with timestamp
+}
+
+// missedMessages returns the messages in all chats at or after the position in
+// positions, or since if a chat is missing in positions. Messages at the
+// position that have already been sent are skipped.
+func missedMessages(
+	ctx context.Context,
+	wi Instance,
+	since int64,
+	positions map[whapp.ID]*chatPosition,
+) ([]whapp.Message, error) {
+	chats, err := wi.GetAllChats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []whapp.Message
+	for _, chat := range chats {
+		last := since
+		pos, found := positions[chat.ID]
+		if found {
+			last = pos.timestamp
+		}
+		if chat.Timestamp < last {
+			continue
+		}
+
+		messages, err := wi.GetMessagesFromChatTillDate(ctx, chat.ID, last)
+		if err != nil {
+			return res, err
+		}
+		for _, msg := range messages {
+			if found && msg.Timestamp == pos.timestamp && pos.ids[msg.ID.Serialized] {
+				continue
+			}
+			res = append(res, msg)
+		}
+	}
+
+	return res, nil
+}
+
+// Navigate implements whapp.Backend.
+func (b *Bridge) Navigate(ctx context.Context) error {
+	return b.current().wi.Navigate(ctx)
+}
+
+// Open implements whapp.Backend.
+func (b *Bridge) Open(ctx context.Context) (whapp.LoginState, error) {
+	return b.current().wi.Open(ctx)
+}
+
+// GetLocalStorage implements whapp.Backend.
+func (b *Bridge) GetLocalStorage(ctx context.Context) (map[string]string, error) {
+	return b.current().wi.GetLocalStorage(ctx)
+}
+
+// SetLocalStorage implements whapp.Backend.
+func (b *Bridge) SetLocalStorage(ctx context.Context, localStorage map[string]string) error {
+	return b.current().wi.SetLocalStorage(ctx, localStorage)
+}
+
+// GetLoginCode implements whapp.Backend.
+func (b *Bridge) GetLoginCode(ctx context.Context) (string, error) {
+	return b.current().wi.GetLoginCode(ctx)
+}
+
+// WaitLogin implements whapp.Backend.
+func (b *Bridge) WaitLogin(ctx context.Context) error {
+	return b.current().wi.WaitLogin(ctx)
+}
+
+// GetMe implements whapp.Backend.
+func (b *Bridge) GetMe(ctx context.Context) (whapp.Me, error) {
+	return b.current().wi.GetMe(ctx)
+}
+
+// SendMessageToChatID implements whapp.Backend.
+func (b *Bridge) SendMessageToChatID(ctx context.Context, chatID whapp.ID, message string) (whapp.MessageID, error) {
+	return b.current().wi.SendMessageToChatID(ctx, chatID, message)
+}
+
+// SendReplyToChatID implements whapp.Backend.
+func (b *Bridge) SendReplyToChatID(
+	ctx context.Context,
+	chatID whapp.ID,
+	message string,
+	quotedID whapp.MessageID,
+) (whapp.MessageID, error) {
+	return b.current().wi.SendReplyToChatID(ctx, chatID, message, quotedID)
+}
+
+// SendMediaToChatID implements whapp.Backend.
+func (b *Bridge) SendMediaToChatID(
+	ctx context.Context,
+	chatID whapp.ID,
+	file whapp.MediaFile,
+	caption string,
+) (whapp.MessageID, error) {
+	return b.current().wi.SendMediaToChatID(ctx, chatID, file, caption)
+}
+
+// SendReaction implements whapp.Backend.
+func (b *Bridge) SendReaction(ctx context.Context, msgID whapp.MessageID, reaction string) error {
+	return b.current().wi.SendReaction(ctx, msgID, reaction)
+}
+
+// DownloadMedia implements whapp.Backend.
+func (b *Bridge) DownloadMedia(ctx context.Context, msg whapp.Message) ([]byte, error) {
+	return b.current().wi.DownloadMedia(ctx, msg)
+}
+
+// GetAllChats implements whapp.Backend.
+func (b *Bridge) GetAllChats(ctx context.Context) ([]whapp.Chat, error) {
+	return b.current().wi.GetAllChats(ctx)
+}
+
+// GetParticipants implements whapp.Backend.
+func (b *Bridge) GetParticipants(ctx context.Context, chatID whapp.ID) ([]whapp.Participant, error) {
+	return b.current().wi.GetParticipants(ctx, chatID)
+}
+
+// GetPresence implements whapp.Backend.
+func (b *Bridge) GetPresence(ctx context.Context, chatID whapp.ID) (whapp.Presence, error) {
+	return b.current().wi.GetPresence(ctx, chatID)
+}
+
+// GetMessagesFromChatTillDate implements whapp.Backend.
+func (b *Bridge) GetMessagesFromChatTillDate(
+	ctx context.Context,
+	chatID whapp.ID,
+	timestamp int64,
+) ([]whapp.Message, error) {
+	return b.current().wi.GetMessagesFromChatTillDate(ctx, chatID, timestamp)
+}
+
+// SendSeen implements whapp.Backend.
+func (b *Bridge) SendSeen(ctx context.Context, chatID whapp.ID) error {
+	return b.current().wi.SendSeen(ctx, chatID)
+}
+
+// SendChatState implements whapp.Backend.
+func (b *Bridge) SendChatState(ctx context.Context, chatID whapp.ID, state string) error {
+	return b.current().wi.SendChatState(ctx, chatID, state)
+}
+
+// GetCommonGroups implements whapp.Backend.
+func (b *Bridge) GetCommonGroups(ctx context.Context, contactID whapp.ID) ([]whapp.Chat, error) {
+	return b.current().wi.GetCommonGroups(ctx, contactID)
+}
+
+// SetAdmin implements whapp.Backend.
+func (b *Bridge) SetAdmin(ctx context.Context, chatID, userID whapp.ID, setAdmin bool) error {
+	return b.current().wi.SetAdmin(ctx, chatID, userID, setAdmin)
+}
+
+// AddParticipant implements whapp.Backend.
+func (b *Bridge) AddParticipant(ctx context.Context, chatID, userID whapp.ID) error {
+	return b.current().wi.AddParticipant(ctx, chatID, userID)
+}
+
+// RemoveParticipant implements whapp.Backend.
+func (b *Bridge) RemoveParticipant(ctx context.Context, chatID, userID whapp.ID) error {
+	return b.current().wi.RemoveParticipant(ctx, chatID, userID)
+}
+
+// Shutdown implements whapp.Backend.
+func (b *Bridge) Shutdown(ctx context.Context) error {
+	return b.current().wi.Shutdown(ctx)
+}
+
+var _ whapp.Backend = (*Bridge)(nil)
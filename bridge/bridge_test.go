@@ -0,0 +1,124 @@
+package bridge
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+	"whapp-irc/whapp"
+	"whapp-irc/whapp/fake"
+)
+
+func TestRecoverMissedMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now().Unix()
+	bob := whapp.Contact{ID: whapp.ID{User: "31600000002", Server: "c.us"}}
+	chat := whapp.Chat{ID: bob.ID, Timestamp: now, Contact: bob}
+	message := func(timestamp int64, body string) whapp.Message {
+		return whapp.Message{
+			Type:      "chat",
+			Timestamp: timestamp,
+			Sender:    &bob,
+			From:      bob.ID,
+			Body:      body,
+			Chat:      chat,
+		}
+	}
+
+	wi := fake.New(whapp.Me{SelfID: whapp.ID{User: "31600000000", Server: "c.us"}})
+	wi.AddChat(chat)
+
+	var launched int32
+	b, err := start(ctx, func() (Instance, error) {
+		atomic.AddInt32(&launched, 1)
+		return wi, nil
+	}, Hooks{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messageCh, errCh := b.ListenForMessages(ctx, time.Second)
+	expect := func(body string) {
+		t.Helper()
+
+		select {
+		case msg := <-messageCh:
+			if msg.Body != body {
+				t.Fatalf("expected message %q, got %q", body, msg.Body)
+			}
+		case err := <-errCh:
+			t.Fatalf("unexpected error: %s", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout while waiting for message %q", body)
+		}
+	}
+
+	wi.Receive(message(now, "one"))
+	wi.Receive(message(now, "two"))
+	expect("one")
+	expect("two")
+
+	// messages received while chromium is down are only in the history, one
+	// of them with the same timestamp as the messages already sent.
+	wi.AddHistory(message(now, "three"))
+	wi.AddHistory(message(now+1, "four"))
+	wi.Reset(whapp.ResetCrash)
+
+	expect("three")
+	expect("four")
+
+	wi.Receive(message(now+2, "five"))
+	expect("five")
+
+	select {
+	case msg := <-messageCh:
+		t.Errorf("unexpected message %q", msg.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if n := atomic.LoadInt32(&launched); n != 2 {
+		t.Errorf("expected chromium to be relaunched once, launched %d times", n)
+	}
+}
+
+func TestRecoverLoggedOut(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	me := whapp.Me{SelfID: whapp.ID{User: "31600000000", Server: "c.us"}}
+	var launched int32
+	b, err := start(ctx, func() (Instance, error) {
+		// the relaunched instance finds the session logged out.
+		wi := fake.New(me)
+		if atomic.AddInt32(&launched, 1) > 1 {
+			wi.SetLoginState(whapp.Loggedout)
+		}
+		return wi, nil
+	}, Hooks{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- b.recover(b.current(), whapp.ResetCrash)
+	}()
+	select {
+	case err := <-done:
+		if err != whapp.ErrLoggedOut {
+			t.Fatalf("expected ErrLoggedOut, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("recovering a logged out session is retried")
+	}
+
+	// later attempts fail right away as well.
+	if err := b.recover(b.current(), whapp.ResetReload); err != whapp.ErrLoggedOut {
+		t.Errorf("expected ErrLoggedOut, got %v", err)
+	}
+	if n := atomic.LoadInt32(&launched); n != 2 {
+		t.Errorf("expected chromium to be relaunched once, launched %d times", n)
+	}
+}
@@ -15,7 +15,8 @@ type Map struct {
 	started  bool
 	finished bool
 
-	caps []string
+	version int
+	caps    []string
 }
 
 // MakeMap returns a new Map.
@@ -25,15 +26,54 @@ func MakeMap() *Map {
 	}
 }
 
-// Add adds the given capability to the map.
+// Add adds the given capability to the map, if it isn't in it already.
 func (cm *Map) Add(cap string) {
 	cap = strings.TrimSpace(cap)
+	if cm.Has(cap) {
+		return
+	}
 
 	cm.mu.Lock()
 	cm.caps = append(cm.caps, cap)
 	cm.mu.Unlock()
 }
 
+// Remove removes the given capability from the map.
+func (cm *Map) Remove(cap string) {
+	cap = strings.ToUpper(strings.TrimSpace(cap))
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	res := cm.caps[:0]
+	for _, x := range cm.caps {
+		if strings.ToUpper(x) != cap {
+			res = append(res, x)
+		}
+	}
+	cm.caps = res
+}
+
+// SetVersion sets the CAP version used by the client to the given version, if
+// it's higher than the current one.
+func (cm *Map) SetVersion(version int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if version > cm.version {
+		cm.version = version
+	}
+}
+
+// Version returns the CAP version used by the client, or 0 if it didn't
+// provide one.
+func (cm *Map) Version() int {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	return cm.version
+}
+
 // Has returns whether or not the given capability has been negotiated.
 func (cm *Map) Has(cap string) bool {
 	cap = strings.ToUpper(cap)
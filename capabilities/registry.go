@@ -0,0 +1,198 @@
+package capabilities
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// A Capability is a capability supported by the server, Value is advertised to
+// clients supporting CAP version 302 and may be empty.
+type Capability struct {
+	Name  string
+	Value string
+}
+
+// Format formats the current Capability as advertised in CAP LS, with its
+// value if withValue is true.
+func (c Capability) Format(withValue bool) string {
+	if !withValue || c.Value == "" {
+		return c.Name
+	}
+	return c.Name + "=" + c.Value
+}
+
+// A Change is a capability that has been added to or removed from a Registry.
+type Change struct {
+	Capability
+	Removed bool
+}
+
+// A subscriber receives the changes to a registry. Changes are queued, so a
+// slow subscriber doesn't block the registry, and only the last change to a
+// capability is kept.
+type subscriber struct {
+	ctx context.Context
+	ch  chan Change
+
+	mu      sync.Mutex
+	pending []Change      // changes not sent yet, at most one per capability
+	wake    chan struct{} // signalled when a change has been queued
+}
+
+// push queues the given change, replacing a queued change to the same
+// capability.
+func (s *subscriber) push(change Change) {
+	s.mu.Lock()
+	queued := false
+	for i, c := range s.pending {
+		if c.Name == change.Name {
+			s.pending[i] = change
+			queued = true
+			break
+		}
+	}
+	if !queued {
+		s.pending = append(s.pending, change)
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends the queued changes on ch, until ctx is done.
+func (s *subscriber) run() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.wake:
+		}
+
+		for {
+			s.mu.Lock()
+			if len(s.pending) == 0 {
+				s.mu.Unlock()
+				break
+			}
+			change := s.pending[0]
+			s.pending = s.pending[1:]
+			s.mu.Unlock()
+
+			select {
+			case <-s.ctx.Done():
+				return
+			case s.ch <- change:
+			}
+		}
+	}
+}
+
+// A Registry contains the capabilities supported by the server.
+type Registry struct {
+	mu          sync.RWMutex
+	caps        map[string]Capability
+	subscribers map[*subscriber]bool
+}
+
+// NewRegistry returns a new empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		caps:        make(map[string]Capability),
+		subscribers: make(map[*subscriber]bool),
+	}
+}
+
+// Server contains the capabilities supported by whapp-irc. Features register
+// their capabilities here, usually in an init function.
+var Server = NewRegistry()
+
+// Register adds the capability with the given name and value to the registry,
+// or updates its value if it's already registered.
+func (r *Registry) Register(name, value string) {
+	c := Capability{name, value}
+
+	r.mu.Lock()
+	r.caps[name] = c
+	r.mu.Unlock()
+
+	r.notify(Change{Capability: c})
+}
+
+// Unregister removes the capability with the given name from the registry.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	c, has := r.caps[name]
+	delete(r.caps, name)
+	r.mu.Unlock()
+
+	if has {
+		r.notify(Change{Capability: c, Removed: true})
+	}
+}
+
+// Get returns the capability with the given name, if it's registered.
+func (r *Registry) Get(name string) (Capability, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c, has := r.caps[name]
+	return c, has
+}
+
+// List returns all registered capabilities, sorted by name.
+func (r *Registry) List() []Capability {
+	r.mu.RLock()
+	res := make([]Capability, 0, len(r.caps))
+	for _, c := range r.caps {
+		res = append(res, c)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// Subscribe returns a channel on which changes to the registry are sent, until
+// ctx is done. The channel is never closed.
+func (r *Registry) Subscribe(ctx context.Context) <-chan Change {
+	sub := &subscriber{
+		ctx:  ctx,
+		ch:   make(chan Change),
+		wake: make(chan struct{}, 1),
+	}
+
+	r.mu.Lock()
+	r.subscribers[sub] = true
+	r.mu.Unlock()
+
+	go sub.run()
+
+	go func() {
+		<-ctx.Done()
+
+		r.mu.Lock()
+		delete(r.subscribers, sub)
+		r.mu.Unlock()
+	}()
+
+	return sub.ch
+}
+
+func (r *Registry) notify(change Change) {
+	r.mu.RLock()
+	subscribers := make([]*subscriber, 0, len(r.subscribers))
+	for sub := range r.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	r.mu.RUnlock()
+
+	for _, sub := range subscribers {
+		sub.push(change)
+	}
+}
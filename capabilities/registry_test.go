@@ -0,0 +1,50 @@
+package capabilities
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSlowSubscriber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := NewRegistry()
+	slow := r.Subscribe(ctx)
+	changes := r.Subscribe(ctx)
+
+	// nobody reads from slow, which shouldn't block registering.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			r.Register("example", "value")
+		}
+		r.Unregister("example")
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("registering blocked on a slow subscriber")
+	}
+
+	// the changes to a capability are coalesced, so both get the removal
+	// without all the registrations before it.
+	for _, ch := range []<-chan Change{changes, slow} {
+		for n := 0; ; n++ {
+			var change Change
+			select {
+			case change = <-ch:
+			case <-time.After(time.Second):
+				t.Fatal("subscriber didn't get the removal")
+			}
+
+			if change.Name != "example" || n > 2 {
+				t.Fatalf("unexpected change %+v", change)
+			} else if change.Removed {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"whapp-irc/capabilities"
+	"whapp-irc/ircconnection"
+	"whapp-irc/whapp"
+)
+
+func init() {
+	capabilities.Server.Register("draft/chathistory", "")
+}
+
+// maxChatHistory is the maximum amount of messages returned for a single
+// CHATHISTORY command, it's advertised in ISUPPORT.
+const maxChatHistory = 100
+
+// historyWindows are the durations, in seconds, looked back in turn when
+// loading messages before some point in a chat. Loading is stopped as soon as
+// enough messages are found, messages older than the last window aren't
+// loaded.
+var historyWindows = []int64{
+	60 * 60,
+	24 * 60 * 60,
+	7 * 24 * 60 * 60,
+	30 * 24 * 60 * 60,
+	365 * 24 * 60 * 60,
+}
+
+// historyRef is a point in the history of a chat, as given in a CHATHISTORY
+// command.
+type historyRef struct {
+	time  time.Time
+	msgID string // the serialized ID of the message, if given by msgid
+}
+
+// parseHistoryRef parses the given CHATHISTORY message reference, which is
+// either timestamp=... or msgid=....
+func (conn *Connection) parseHistoryRef(str string) (historyRef, error) {
+	parts := strings.SplitN(str, "=", 2)
+	if len(parts) != 2 {
+		return historyRef{}, fmt.Errorf("invalid message reference %s", str)
+	}
+
+	switch parts[0] {
+	case "timestamp":
+		t, err := time.Parse(time.RFC3339Nano, parts[1])
+		if err != nil {
+			return historyRef{}, fmt.Errorf("invalid timestamp %s", parts[1])
+		}
+		return historyRef{time: t}, nil
+
+	case "msgid":
+		msg, found := conn.messageByMsgID(parts[1])
+		if !found {
+			return historyRef{}, fmt.Errorf("unknown msgid %s", parts[1])
+		}
+		return historyRef{msg.Time(), msg.ID.Serialized}, nil
+
+	default:
+		return historyRef{}, fmt.Errorf("invalid message reference %s", str)
+	}
+}
+
+// index returns the index of the message referenced by the current reference
+// in the given messages, or -1 if it isn't a msgid reference or the message
+// isn't in messages.
+func (ref historyRef) index(messages []whapp.Message) int {
+	if ref.msgID != "" {
+		for i, msg := range messages {
+			if msg.ID.Serialized == ref.msgID {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// before returns the amount of messages in the given sorted messages that are
+// before the current reference.
+func (ref historyRef) before(messages []whapp.Message) int {
+	if i := ref.index(messages); i != -1 {
+		return i
+	}
+
+	for i, msg := range messages {
+		if !msg.Time().Before(ref.time) {
+			return i
+		}
+	}
+	return len(messages)
+}
+
+// after returns the index of the first message in the given sorted messages
+// that's after the current reference.
+func (ref historyRef) after(messages []whapp.Message) int {
+	if i := ref.index(messages); i != -1 {
+		return i + 1
+	}
+
+	for i, msg := range messages {
+		if msg.Time().After(ref.time) {
+			return i
+		}
+	}
+	return len(messages)
+}
+
+// history returns the messages in the given chat since the given timestamp,
+// without notifications.
+func (conn *Connection) history(ctx context.Context, chatID whapp.ID, since int64) ([]whapp.Message, error) {
+	messages, err := conn.WI.GetMessagesFromChatTillDate(ctx, chatID, since)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []whapp.Message
+	for _, msg := range messages {
+		if !msg.IsNotification && msg.Type != "e2e_notification" {
+			res = append(res, msg)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Timestamp < res[j].Timestamp
+	})
+	return res, nil
+}
+
+// historyBefore returns at most limit messages in the given chat before ref.
+func (conn *Connection) historyBefore(
+	ctx context.Context,
+	chatID whapp.ID,
+	ref historyRef,
+	limit int,
+) ([]whapp.Message, error) {
+	until := ref.time.Unix()
+
+	for i, window := range historyWindows {
+		messages, err := conn.history(ctx, chatID, until-window)
+		if err != nil {
+			return nil, err
+		}
+
+		n := ref.before(messages)
+		if n >= limit || i == len(historyWindows)-1 {
+			start := n - limit
+			if start < 0 {
+				start = 0
+			}
+			return messages[start:n], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// historyAfter returns the messages in the given chat after ref, going back at
+// most the last history window from now.
+func (conn *Connection) historyAfter(
+	ctx context.Context,
+	chatID whapp.ID,
+	ref historyRef,
+) ([]whapp.Message, error) {
+	since := ref.time.Unix()
+	if min := time.Now().Unix() - historyWindows[len(historyWindows)-1]; since < min {
+		since = min
+	}
+
+	messages, err := conn.history(ctx, chatID, since)
+	if err != nil {
+		return nil, err
+	}
+	return messages[ref.after(messages):], nil
+}
+
+// first returns the first n messages of the given messages.
+func first(messages []whapp.Message, n int) []whapp.Message {
+	if len(messages) > n {
+		return messages[:n]
+	}
+	return messages
+}
+
+// last returns the last n messages of the given messages.
+func last(messages []whapp.Message, n int) []whapp.Message {
+	if len(messages) > n {
+		return messages[len(messages)-n:]
+	}
+	return messages
+}
+
+// handleChatHistory handles the CHATHISTORY command with the given parameters
+// sent by the given client.
+func (conn *Connection) handleChatHistory(
+	ctx context.Context,
+	client *ircconnection.Connection,
+	params []string,
+) error {
+	fail := func(code string, args []string, description string) error {
+		parts := append([]string{":whapp-irc FAIL CHATHISTORY", code}, args...)
+		str := strings.Join(append(parts, ":"+description), " ")
+		return client.WriteNow(str)
+	}
+
+	if len(params) < 2 {
+		return fail("NEED_MORE_PARAMS", nil, "Missing parameters")
+	}
+	subcommand := strings.ToUpper(params[0])
+
+	// the last parameter is always the limit
+	limit, err := strconv.Atoi(params[len(params)-1])
+	if err != nil || limit <= 0 {
+		return fail("INVALID_PARAMS", params[:1], "Invalid limit")
+	}
+	if limit > maxChatHistory {
+		limit = maxChatHistory
+	}
+
+	if subcommand == "TARGETS" {
+		if len(params) != 4 {
+			return fail("NEED_MORE_PARAMS", params[:1], "Missing parameters")
+		}
+		return conn.handleChatHistoryTargets(client, params[1], params[2], limit)
+	}
+
+	nRefs := map[string]int{
+		"LATEST":  1,
+		"BEFORE":  1,
+		"AFTER":   1,
+		"AROUND":  1,
+		"BETWEEN": 2,
+	}
+	n, has := nRefs[subcommand]
+	if !has {
+		return fail("INVALID_PARAMS", params[:1], "Unknown subcommand")
+	} else if len(params) != n+3 {
+		return fail("NEED_MORE_PARAMS", params[:1], "Missing parameters")
+	}
+
+	target := params[1]
+	item, has := conn.Chats.ByIdentifier(target, false)
+	if !has {
+		return fail("INVALID_TARGET", params[:2], "Unknown chat")
+	}
+
+	var refs []historyRef
+	for _, str := range params[2 : 2+n] {
+		if subcommand == "LATEST" && str == "*" {
+			// a minute in the future, since the clocks of the phone and
+			// ours might not be exactly the same.
+			refs = append(refs, historyRef{time: time.Now().Add(time.Minute)})
+			continue
+		}
+
+		ref, err := conn.parseHistoryRef(str)
+		if err != nil {
+			return fail("INVALID_PARAMS", params[:2], err.Error())
+		}
+		refs = append(refs, ref)
+	}
+
+	var messages []whapp.Message
+	switch {
+	case subcommand == "LATEST" && params[2] == "*", subcommand == "BEFORE":
+		messages, err = conn.historyBefore(ctx, item.ID, refs[0], limit)
+
+	case subcommand == "LATEST":
+		messages, err = conn.historyAfter(ctx, item.ID, refs[0])
+		messages = last(messages, limit)
+
+	case subcommand == "AFTER":
+		messages, err = conn.historyAfter(ctx, item.ID, refs[0])
+		messages = first(messages, limit)
+
+	case subcommand == "AROUND":
+		var before, after []whapp.Message
+		if before, err = conn.historyBefore(ctx, item.ID, refs[0], limit/2); err != nil {
+			break
+		}
+		if after, err = conn.historyAfter(ctx, item.ID, refs[0]); err != nil {
+			break
+		}
+		messages = append(before, first(after, limit-len(before))...)
+
+	case subcommand == "BETWEEN":
+		start, end := refs[0], refs[1]
+		reversed := end.time.Before(start.time)
+		if reversed {
+			start, end = end, start
+		}
+
+		messages, err = conn.historyAfter(ctx, item.ID, start)
+		messages = messages[:end.before(messages)]
+		if reversed {
+			messages = last(messages, limit)
+		} else {
+			messages = first(messages, limit)
+		}
+	}
+	if err != nil {
+		return fail("MESSAGE_ERROR", params[:2], "Error while loading messages: "+err.Error())
+	}
+
+	batch, err := client.StartBatch("chathistory", item.Identifier)
+	if err != nil {
+		return err
+	}
+
+	fn := handlerBatch(batch)
+	for _, msg := range messages {
+		conn.messages.Add(msg)
+
+		// media isn't downloaded here, a client asking for a lot of history
+		// shouldn't make us download all of it.
+		quoted, message := conn.formatWhappMessage(item, msg)
+		if quoted != nil {
+			if err := fn(client, *quoted); err != nil {
+				return err
+			}
+		}
+		if err := fn(client, message); err != nil {
+			return err
+		}
+	}
+
+	return batch.End()
+}
+
+// handleChatHistoryTargets handles CHATHISTORY TARGETS, listing the chats with
+// messages between the given timestamps.
+func (conn *Connection) handleChatHistoryTargets(
+	client *ircconnection.Connection,
+	start, end string,
+	limit int,
+) error {
+	var refs []historyRef
+	for _, str := range []string{start, end} {
+		ref, err := conn.parseHistoryRef(str)
+		if err != nil || ref.msgID != "" {
+			str := fmt.Sprintf(
+				":whapp-irc FAIL CHATHISTORY INVALID_PARAMS TARGETS :Invalid timestamp %s",
+				str,
+			)
+			return client.WriteNow(str)
+		}
+		refs = append(refs, ref)
+	}
+	if refs[1].time.Before(refs[0].time) {
+		refs[0], refs[1] = refs[1], refs[0]
+	}
+
+	type target struct {
+		identifier string
+		time       time.Time
+	}
+	var targets []target
+	for _, item := range conn.Chats.List(false) {
+		timestamp, found := conn.timestampMap.Get(item.ID)
+		if !found || item.Chat.RawChat.Timestamp > timestamp {
+			timestamp = item.Chat.RawChat.Timestamp
+		}
+
+		t := time.Unix(timestamp, 0)
+		if t.Before(refs[0].time) || t.After(refs[1].time) {
+			continue
+		}
+		targets = append(targets, target{item.Identifier, t})
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].time.Before(targets[j].time)
+	})
+	if len(targets) > limit {
+		targets = targets[:limit]
+	}
+
+	batch, err := client.StartBatch("draft/chathistory-targets")
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		str := fmt.Sprintf(
+			":whapp-irc CHATHISTORY TARGETS %s %s",
+			target.identifier,
+			target.time.UTC().Format(ircconnection.TimeFormat),
+		)
+		if err := client.WriteTags(time.Now(), batch.Tags(nil), str); err != nil {
+			return err
+		}
+	}
+	return batch.End()
+}
@@ -5,23 +5,63 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 	"whapp-irc/maps"
 	"whapp-irc/whapp"
 )
 
+// MarkReadPolicy is the policy for marking WhatsApp chats as read, for clients
+// that don't support draft/read-marker.
+type MarkReadPolicy int
+
+const (
+	// MarkReadReply marks a chat as read when the user sends a message in it.
+	MarkReadReply MarkReadPolicy = iota
+	// MarkReadDeliver marks a chat as read as soon as a new message in it is
+	// sent to a client.
+	MarkReadDeliver
+	// MarkReadNever never marks chats as read.
+	MarkReadNever
+)
+
 // Config contains all the possible configuration options and their values
 type Config struct {
 	FileServerHost  string
 	FileServerPort  string
 	FileServerHTTPS bool
 
-	IRCPort string
+	IRCPort      string
+	IRCPlaintext bool
+
+	// IRCTLSCert and IRCTLSKey are the paths to the certificate and key used
+	// for the TLS listener on IRCTLSPort. When they are empty, there's no TLS
+	// listener.
+	IRCTLSPort string
+	IRCTLSCert string
+	IRCTLSKey  string
 
 	LogLevel whapp.LoggingLevel
 
 	MapProvider maps.Provider
 
 	AlternativeReplay bool
+
+	MarkRead MarkReadPolicy
+
+	// UploadHosts are the hosts from which files linked in messages sent from
+	// IRC are uploaded to WhatsApp, besides the file server itself. "*" allows
+	// every host.
+	UploadHosts []string
+
+	// MediaMaxAge, MediaMaxSize and MediaUserQuota are the retention policy
+	// of the files on the file server, zero means no limit.
+	MediaMaxAge    time.Duration
+	MediaMaxSize   int64
+	MediaUserQuota int64
+
+	// MediaURLExpiry is how long the signed links to files on the file server
+	// are valid, zero means forever.
+	MediaURLExpiry time.Duration
 }
 
 func getEnvDefault(env, def string) string {
@@ -32,6 +72,27 @@ func getEnvDefault(env, def string) string {
 	return res
 }
 
+// parseSize parses the given size in bytes, optionally suffixed with K, M or
+// G.
+func parseSize(raw string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(raw))
+
+	multiplier := int64(1)
+	for i, suffix := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(str, suffix) {
+			multiplier = 1 << (10 * uint(i+1))
+			str = strings.TrimSuffix(str, suffix)
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %s", raw)
+	}
+	return n * multiplier, nil
+}
+
 // ReadEnvVars reads environment variables and returns a Config instance
 // containing the parsed values, or an error.
 func ReadEnvVars() (Config, error) {
@@ -39,15 +100,38 @@ func ReadEnvVars() (Config, error) {
 	fileServerPort := getEnvDefault("FILE_SERVER_PORT", "3000")
 	fileServerUseHTTPS := getEnvDefault("FILE_SERVER_HTTPS", "false")
 	ircPort := getEnvDefault("IRC_SERVER_PORT", "6060")
+	ircPlaintextRaw := getEnvDefault("IRC_SERVER_PLAINTEXT", "true")
+	ircTLSPort := getEnvDefault("IRC_SERVER_TLS_PORT", "6697")
+	ircTLSCert := getEnvDefault("IRC_SERVER_TLS_CERT", "")
+	ircTLSKey := getEnvDefault("IRC_SERVER_TLS_KEY", "")
 	logLevelRaw := getEnvDefault("LOG_LEVEL", "normal")
 	mapProviderRaw := getEnvDefault("MAP_PROVIDER", "google-maps")
 	replayMode := getEnvDefault("REPLAY_MODE", "normal")
+	markReadRaw := getEnvDefault("MARK_READ", "reply")
+	uploadHostsRaw := getEnvDefault("UPLOAD_HOSTS", "")
+	mediaMaxAgeRaw := getEnvDefault("MEDIA_MAX_AGE", "0")
+	mediaMaxSizeRaw := getEnvDefault("MEDIA_MAX_SIZE", "0")
+	mediaUserQuotaRaw := getEnvDefault("MEDIA_USER_QUOTA", "0")
+	mediaURLExpiryRaw := getEnvDefault("MEDIA_URL_EXPIRY", "168h")
 
 	useHTTPS, err := strconv.ParseBool(fileServerUseHTTPS)
 	if err != nil {
 		return Config{}, err
 	}
 
+	ircPlaintext, err := strconv.ParseBool(ircPlaintextRaw)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if (ircTLSCert == "") != (ircTLSKey == "") {
+		err := fmt.Errorf("both IRC_SERVER_TLS_CERT and IRC_SERVER_TLS_KEY should be set")
+		return Config{}, err
+	} else if !ircPlaintext && ircTLSCert == "" {
+		err := fmt.Errorf("plaintext IRC is disabled, but no TLS certificate is set")
+		return Config{}, err
+	}
+
 	var logLevel whapp.LoggingLevel
 	switch strings.ToLower(logLevelRaw) {
 	case "verbose":
@@ -72,17 +156,71 @@ func ReadEnvVars() (Config, error) {
 		return Config{}, err
 	}
 
+	var markRead MarkReadPolicy
+	switch strings.ToLower(markReadRaw) {
+	case "reply":
+		markRead = MarkReadReply
+	case "deliver":
+		markRead = MarkReadDeliver
+	case "never":
+		markRead = MarkReadNever
+
+	default:
+		err := fmt.Errorf("no mark read policy %s found", markReadRaw)
+		return Config{}, err
+	}
+
+	mediaMaxAge, err := time.ParseDuration(mediaMaxAgeRaw)
+	if err != nil {
+		return Config{}, err
+	}
+	mediaMaxSize, err := parseSize(mediaMaxSizeRaw)
+	if err != nil {
+		return Config{}, err
+	}
+	mediaUserQuota, err := parseSize(mediaUserQuotaRaw)
+	if err != nil {
+		return Config{}, err
+	}
+
+	mediaURLExpiry, err := time.ParseDuration(mediaURLExpiryRaw)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var uploadHosts []string
+	for _, h := range strings.Split(uploadHostsRaw, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			uploadHosts = append(uploadHosts, strings.ToLower(h))
+		}
+	}
+
 	return Config{
 		FileServerHost:  host,
 		FileServerPort:  fileServerPort,
 		FileServerHTTPS: useHTTPS,
 
-		IRCPort: ircPort,
+		IRCPort:      ircPort,
+		IRCPlaintext: ircPlaintext,
+
+		IRCTLSPort: ircTLSPort,
+		IRCTLSCert: ircTLSCert,
+		IRCTLSKey:  ircTLSKey,
 
 		LogLevel: logLevel,
 
 		MapProvider: mapProvider,
 
 		AlternativeReplay: replayMode == "alternative",
+
+		MarkRead: markRead,
+
+		UploadHosts: uploadHosts,
+
+		MediaMaxAge:    mediaMaxAge,
+		MediaMaxSize:   mediaMaxSize,
+		MediaUserQuota: mediaUserQuota,
+
+		MediaURLExpiry: mediaURLExpiry,
 	}, nil
 }
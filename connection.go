@@ -8,8 +8,10 @@ import (
 	"math"
 	"net"
 	"strings"
+	"sync"
 	"time"
 	"whapp-irc/ircconnection"
+	"whapp-irc/messagemap"
 	"whapp-irc/timestampmap"
 	"whapp-irc/types"
 	"whapp-irc/util"
@@ -20,25 +22,55 @@ import (
 // time, and during connection setup.
 const ircMessageQueueSize = 10
 
-// A Connection represents the internal state of a whapp-irc connection.
+// A Connection represents the internal state of a whapp-irc connection. It
+// lives as long as the WhatsApp session, independent of the IRC clients
+// attached to it.
 type Connection struct {
-	WI    *whapp.Instance
+	WI    whapp.Backend
 	Chats *types.ChatList
 
-	irc *ircconnection.Connection
+	// ctx is done when the WhatsApp session ends, stop ends it.
+	ctx  context.Context
+	stop context.CancelFunc
+
+	nick            string
+	passwordHash    string
+	certFingerprint string
+
+	// uploadToken is the password for uploading files to the file server,
+	// it's protected by mu.
+	uploadToken string
+
+	// clients are the currently attached IRC clients, with the function to
+	// disconnect them. If there are none, new WhatsApp messages are stored in
+	// detachedMessages. mu also protects the MessageIDs of the chats.
+	mu               sync.Mutex
+	clients          map[*ircconnection.Connection]context.CancelFunc
+	detachedMessages []whapp.Message
+
+	// deliverMu is held while delivering or replaying WhatsApp messages, so
+	// a client attaching gets them in order.
+	deliverMu sync.Mutex
+
+	// sentReactions contains the reactions sent from IRC, by the serialized
+	// ID of the message reacted to, until WhatsApp reports them back.
+	sentReactions map[string]string
+
+	readMarkers readMarkers
 
 	timestampMap *timestampmap.Map
+	messages     *messagemap.Map
 
 	me           whapp.Me
 	localStorage map[string]string
 }
 
-// BindSocket binds the given TCP connection.
-func BindSocket(socket *net.TCPConn) error {
+// BindSocket binds the given connection.
+func BindSocket(socket net.Conn) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	irc := ircconnection.HandleConnection(ctx, socket)
+	irc := ircconnection.HandleConnection(ctx, socket, authenticate)
 
 	// when the irc connection dies or the context is cancelled, kill
 	// everything off
@@ -61,13 +93,19 @@ func BindSocket(socket *net.TCPConn) error {
 		return fmt.Errorf("nickname can't be empty")
 	}
 
+	// if the client started capabilities negotiation, wait for it to finish,
+	// since the client might authenticate using SASL during it.
+	if _, ok := irc.Caps.WaitNegotiation(ctx); !ok {
+		return nil
+	}
+
 	// send welcome message
 	if err := irc.WriteListNow([]string{
 		fmt.Sprintf(":whapp-irc 001 %s :Welcome to whapp-irc, %s.", irc.Nick(), irc.Nick()),
 		fmt.Sprintf(":whapp-irc 002 %s :Your host is whapp-irc.", irc.Nick()),
 		fmt.Sprintf(":whapp-irc 003 %s :This server was created %s.", irc.Nick(), startTime),
 		fmt.Sprintf(":whapp-irc 004 %s :", irc.Nick()),
-		fmt.Sprintf(":whapp-irc 005 %s PREFIX=(qo)~@ CHARSET=UTF-8 :are supported by this server", irc.Nick()),
+		fmt.Sprintf(":whapp-irc 005 %s PREFIX=(qo)~@ CHARSET=UTF-8 CHATHISTORY=%d MSGREFTYPES=msgid,timestamp%s :are supported by this server", irc.Nick(), maxChatHistory, fileHostToken()),
 		fmt.Sprintf(":whapp-irc 375 %s :The server is running on commit %s", irc.Nick(), commit),
 		fmt.Sprintf(":whapp-irc 372 %s :Enjoy the ride.", irc.Nick()),
 		fmt.Sprintf(":whapp-irc 376 %s :End of /MOTD command.", irc.Nick()),
@@ -75,13 +113,20 @@ func BindSocket(socket *net.TCPConn) error {
 		return err
 	}
 
+	if account := irc.Account(); account != "" && account != irc.Nick() {
+		err := fmt.Errorf("authenticated as %s, but using nick %s", account, irc.Nick())
+		irc.Status(err.Error())
+		return err
+	}
+
 	var user types.User
 	if found, err := userDb.GetItem(
 		irc.Nick(),
 		&user,
-	); err == nil && found && user.Password != "" {
-		// we've found an user with a password, so the current connection should
-		// also provide a password.
+	); err == nil && found && irc.Account() == "" && user.HasCredentials() {
+		// we've found an user with a password or client certificate and the
+		// client didn't authenticate using SASL, so the current connection
+		// should provide one of them.
 
 		// passErr notifies the connection that the provided password is
 		// incorrect, or none have been provided but should've been.
@@ -93,35 +138,47 @@ func BindSocket(socket *net.TCPConn) error {
 			return goodErr
 		}
 
-		select {
-		case <-ctx.Done():
-			return nil
+		// a matching client certificate is enough, otherwise we need the
+		// password.
+		fingerprint := irc.CertFingerprint()
+		if user.CertFingerprint == "" || fingerprint != user.CertFingerprint {
+			if user.Password == "" {
+				err := fmt.Errorf("client certificate expected, but none or an incorrect one provided")
+				return passErr(err)
+			}
 
-		case <-time.After(5 * time.Second):
-			err := fmt.Errorf("password expected, but client timed out")
-			return passErr(err)
+			select {
+			case <-ctx.Done():
+				return nil
 
-		case <-irc.PassSetChannel():
-			if irc.Pass() != user.Password {
-				err := fmt.Errorf("client provided password incorrect")
+			case <-time.After(5 * time.Second):
+				err := fmt.Errorf("password expected, but client timed out")
 				return passErr(err)
+
+			case <-irc.PassSetChannel():
+				if !user.CheckPassword(irc.Pass()) {
+					err := fmt.Errorf("client provided password incorrect")
+					return passErr(err)
+				}
 			}
 		}
 	}
 
-	// setup bridge and connection
-	conn, err := setupConnection(ctx, irc)
+	// get the running session for this nick, or setup a new bridge and
+	// connection.
+	conn, isNew, err := getConnection(ctx, cancel, irc)
 	if err != nil {
 		irc.Status("error setting up whapp bridge: " + err.Error())
 		return err
 	}
+	defer conn.detach(irc)
 
 	// now that we have set-up the bridge...
 
 	// actually handle most of the IRC messages
 	go func() {
 		defer cancel()
-		ircReceiveCh := conn.irc.ReceiveChannel()
+		ircReceiveCh := irc.ReceiveChannel()
 
 		for {
 			select {
@@ -133,7 +190,7 @@ func BindSocket(socket *net.TCPConn) error {
 					return
 				}
 
-				if err := conn.handleIRCCommand(ctx, msg); err != nil {
+				if err := conn.handleIRCCommand(ctx, irc, msg); err != nil {
 					log.Printf("error handling new irc message: %s\n", err)
 
 					if err == io.ErrClosedPipe {
@@ -151,8 +208,11 @@ func BindSocket(socket *net.TCPConn) error {
 	// if negotiation hasn't started yet, we just skip through (we figure the
 	// client doesn't support IRCv3, since normally negotiation occurs fairly
 	// early in the connection)
-	started, ok := conn.irc.Caps.WaitNegotiation(ctx)
+	started, ok := irc.Caps.WaitNegotiation(ctx)
 	if !ok {
+		if isNew {
+			conn.start()
+		}
 		return nil
 	} else if !started {
 		str := "IRCv3 capabilities negotiation has not started, " +
@@ -160,14 +220,66 @@ func BindSocket(socket *net.TCPConn) error {
 		log.Printf(str)
 	}
 
-	// replay older messages
+	if isNew {
+		// replay older messages, and start listening for new ones.
+		err := conn.replay(ctx, irc)
+		util.LogIfErr("error while replaying older messages", err)
+		go conn.saveDatabaseEntry()
+
+		conn.start()
+	} else {
+		// rejoin chats and replay the messages received while we were
+		// detached.
+		conn.attach(ctx, irc, cancel)
+	}
+
+	irc.Status("ready for new messages")
+
+	// now just wait until we have to shutdown.
+	<-ctx.Done()
+	log.Printf("connection ended: %s\n", ctx.Err())
+	return nil
+}
+
+// authenticate checks the given SASL credentials against the user database.
+// Like with PASS, any credentials are accepted for users without a password or
+// client certificate, they will be stored for later connections.
+func authenticate(creds ircconnection.Credentials) bool {
+	var user types.User
+	found, err := userDb.GetItem(creds.Account, &user)
+	if err != nil {
+		log.Printf("error while getting user %s: %s", creds.Account, err)
+		return false
+	} else if !found || !user.HasCredentials() {
+		return true
+	}
+
+	switch creds.Mechanism {
+	case ircconnection.SASLPlain:
+		return user.CheckPassword(creds.Password)
+	case ircconnection.SASLExternal:
+		return user.CertFingerprint != "" &&
+			creds.CertFingerprint == user.CertFingerprint
+	}
+
+	return false
+}
+
+// replay replays the messages received since the timestamps stored in the
+// database to the given client, if it wants a replay.
+func (conn *Connection) replay(ctx context.Context, irc *ircconnection.Connection) error {
+	replayer := &replayBatcher{conn: conn, irc: irc}
+	defer func() {
+		util.LogIfErr("error ending replay batch", replayer.end())
+	}()
+
 	empty := conn.timestampMap.Length() == 0
 	for _, item := range conn.Chats.List(false) {
 		c := item.Chat
 
 		prevTimestamp, found := conn.timestampMap.Get(c.ID)
 
-		if empty || !conn.hasReplay() {
+		if empty || !hasReplay(irc) {
 			conn.timestampMap.Set(c.ID, c.RawChat.Timestamp)
 			continue
 		} else if c.RawChat.Timestamp <= prevTimestamp {
@@ -185,8 +297,7 @@ func BindSocket(socket *net.TCPConn) error {
 			prevTimestamp,
 		)
 		if err != nil {
-			log.Printf("error while loading earlier messages: %s\n", err.Error())
-			return err
+			return fmt.Errorf("error while loading earlier messages: %s", err)
 		}
 
 		for _, msg := range messages {
@@ -194,82 +305,16 @@ func BindSocket(socket *net.TCPConn) error {
 				continue
 			}
 
-			err := conn.handleWhappMessageReplay(ctx, msg)
+			err := replayer.add(ctx, msg)
 			util.LogIfErr("error handling older whapp message", err)
 		}
 	}
-	go conn.saveDatabaseEntry()
-
-	conn.irc.Status("ready for new messages")
-
-	// handle logging out on whatsapp web, this happens when the user removes
-	// the bridge client on their phone.
-	go func() {
-		defer cancel()
-
-		resCh, errCh := conn.WI.ListenLoggedIn(ctx, 3*time.Second)
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-
-			case err := <-errCh:
-				util.LogIfErr("error while listening for whatsapp loggedin state", err)
-				return
-
-			case res := <-resCh:
-				if res {
-					continue
-				}
-
-				conn.irc.Status("logged out of whatsapp")
-
-				return
-			}
-		}
-	}()
-
-	// listen for new WhatsApp messages
-	go func() {
-		defer cancel()
-
-		messageCh, errCh := conn.WI.ListenForMessages(
-			ctx,
-			500*time.Millisecond,
-		)
-		queue := GetMessageQueue(ctx, messageCh, 50)
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-
-			case err := <-errCh:
-				util.LogIfErr("error while listening for whatsapp messages", err)
-				return
 
-			case msgRes := <-<-queue:
-				if msgRes.Err == nil {
-					msgRes.Err = conn.handleWhappMessage(
-						ctx,
-						msgRes.Message,
-						handlerNormal,
-					)
-				}
-
-				util.LogIfErr("error handling new whapp message", msgRes.Err)
-			}
-		}
-	}()
-
-	// now just wait until we have to shutdown.
-	<-ctx.Done()
-	log.Printf("connection ended: %s\n", ctx.Err())
 	return nil
 }
 
-func (conn *Connection) joinChat(item types.ChatListItem) error {
+// joinChat joins the given chat on the given clients.
+func (conn *Connection) joinChat(clients []*ircconnection.Connection, item types.ChatListItem) error {
 	chat := item.Chat
 
 	// sanity checks
@@ -287,30 +332,46 @@ func (conn *Connection) joinChat(item types.ChatListItem) error {
 		return fmt.Errorf("identifier is empty, chat.Name is %s", chat.Name)
 	}
 
+	if err := eachClient(clients, func(irc *ircconnection.Connection) error {
+		return conn.writeJoin(irc, item)
+	}); err != nil {
+		return err
+	}
+
+	chat.Joined = true
+	return nil
+}
+
+// writeJoin sends the JOIN, topic, names and read marker of the given chat to
+// the given client.
+func (conn *Connection) writeJoin(irc *ircconnection.Connection, item types.ChatListItem) error {
+	chat := item.Chat
+	identifier := item.Identifier
+
 	// send JOIN to client
-	str := fmt.Sprintf(":%s JOIN %s", conn.irc.Nick(), identifier)
-	if err := conn.irc.WriteNow(str); err != nil {
+	str := fmt.Sprintf(":%s JOIN %s", irc.Nick(), identifier)
+	if err := irc.WriteNow(str); err != nil {
 		return err
 	}
 
 	// send chat name and description (if any) as topic
-	topic := fmt.Sprintf(":whapp-irc 332 %s %s :%s", conn.irc.Nick(), identifier, chat.Name)
+	topic := fmt.Sprintf(":whapp-irc 332 %s %s :%s", irc.Nick(), identifier, chat.Name)
 	if desc := chat.RawChat.Description; desc != nil {
 		if d := strings.TrimSpace(desc.Description); d != "" {
 			d = strings.Replace(d, "\n", " ", -1)
 			topic = fmt.Sprintf("%s: %s", topic, d)
 		}
 	}
-	conn.irc.WriteNow(topic)
+	irc.WriteNow(topic)
 
 	// send chat members to client
 	names := make([]string, 0)
 	for _, participant := range chat.Participants {
 		if participant.Contact.IsMe {
 			if participant.IsSuperAdmin {
-				conn.irc.WriteNow(fmt.Sprintf(":whapp-irc MODE %s +q %s", identifier, conn.irc.Nick()))
+				irc.WriteNow(fmt.Sprintf(":whapp-irc MODE %s +q %s", identifier, irc.Nick()))
 			} else if participant.IsAdmin {
-				conn.irc.WriteNow(fmt.Sprintf(":whapp-irc MODE %s +o %s", identifier, conn.irc.Nick()))
+				irc.WriteNow(fmt.Sprintf(":whapp-irc MODE %s +o %s", identifier, irc.Nick()))
 			}
 			continue
 		}
@@ -324,16 +385,18 @@ func (conn *Connection) joinChat(item types.ChatListItem) error {
 
 		names = append(names, prefix+participant.SafeName())
 	}
-	str = fmt.Sprintf(":whapp-irc 353 %s @ %s :%s", conn.irc.Nick(), identifier, strings.Join(names, " "))
-	if err := conn.irc.WriteNow(str); err != nil {
+	str = fmt.Sprintf(":whapp-irc 353 %s @ %s :%s", irc.Nick(), identifier, strings.Join(names, " "))
+	if err := irc.WriteNow(str); err != nil {
 		return err
 	}
-	str = fmt.Sprintf(":whapp-irc 366 %s %s :End of /NAMES list.", conn.irc.Nick(), identifier)
-	if err := conn.irc.WriteNow(str); err != nil {
+	str = fmt.Sprintf(":whapp-irc 366 %s %s :End of /NAMES list.", irc.Nick(), identifier)
+	if err := irc.WriteNow(str); err != nil {
 		return err
 	}
 
-	chat.Joined = true
+	if hasReadMarker(irc) {
+		return irc.WriteNow(conn.readMarkerLine(item))
+	}
 	return nil
 }
 
@@ -377,8 +440,14 @@ func (conn *Connection) addChat(chat *types.Chat) types.ChatListItem {
 }
 
 func (conn *Connection) saveDatabaseEntry() error {
-	err := userDb.SaveItem(conn.irc.Nick(), types.User{
-		Password:             conn.irc.Pass(),
+	conn.mu.Lock()
+	uploadToken := conn.uploadToken
+	conn.mu.Unlock()
+
+	err := userDb.SaveItem(conn.nick, types.User{
+		Password:             conn.passwordHash,
+		CertFingerprint:      conn.certFingerprint,
+		UploadToken:          uploadToken,
 		LocalStorage:         conn.localStorage,
 		LastReceivedReceipts: conn.timestampMap.GetCopy(),
 		Chats:                conn.Chats.List(true),
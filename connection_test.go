@@ -0,0 +1,1176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"whapp-irc/capabilities"
+	"whapp-irc/ircconnection"
+	"whapp-irc/types"
+	"whapp-irc/whapp"
+	"whapp-irc/whapp/fake"
+)
+
+func hasCall(b *fake.Backend, call fake.Call) bool {
+	for _, c := range b.Calls() {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
+
+func TestJoinPart(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "joinpart", nil)
+	defer c.Close()
+
+	c.Send("JOIN #TestGroup")
+	c.Expect(`^:joinpart JOIN #TestGroup$`)
+	c.Expect(`^:whapp-irc 332 joinpart #TestGroup :Test Group$`)
+	c.Expect(`^:whapp-irc MODE #TestGroup \+o joinpart$`)
+	c.Expect(`^:whapp-irc 353 joinpart @ #TestGroup :~Alice Bob$`)
+	c.Expect(`^:whapp-irc 366 joinpart #TestGroup `)
+
+	// after parting we should be able to join again.
+	c.Send("PART #TestGroup")
+	c.Expect(`^:joinpart PART #TestGroup$`)
+	c.Send("JOIN #TestGroup")
+	c.Expect(`^:joinpart JOIN #TestGroup$`)
+
+	c.Send("JOIN #Unknown")
+	c.Expect(`PRIVMSG joinpart :chat not found: #Unknown$`)
+}
+
+func TestMode(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "mode", nil)
+	defer c.Close()
+
+	c.Send("MODE #TestGroup +o Bob")
+	c.Expect(`^:mode MODE #TestGroup \+o bob$`)
+
+	if !hasCall(b, fake.Call{
+		Method: "SetAdmin",
+		ChatID: testGroup.ID,
+		UserID: testBob.ID,
+		Admin:  true,
+	}) {
+		t.Errorf("expected SetAdmin call, got %v", b.Calls())
+	}
+
+	c.Send("MODE #TestGroup -o Bob")
+	c.Expect(`^:mode MODE #TestGroup -o bob$`)
+
+	if !hasCall(b, fake.Call{
+		Method: "SetAdmin",
+		ChatID: testGroup.ID,
+		UserID: testBob.ID,
+		Admin:  false,
+	}) {
+		t.Errorf("expected SetAdmin call to remove admin, got %v", b.Calls())
+	}
+}
+
+func TestKick(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "kick", nil)
+	defer c.Close()
+
+	c.Send("KICK #TestGroup Bob")
+	c.Sync()
+
+	if !hasCall(b, fake.Call{
+		Method: "RemoveParticipant",
+		ChatID: testGroup.ID,
+		UserID: testBob.ID,
+	}) {
+		t.Errorf("expected RemoveParticipant call, got %v", b.Calls())
+	}
+
+	c.Send("KICK #Unknown Bob")
+	c.Expect(`^:whapp-irc 403 kick #Unknown :No such channel$`)
+}
+
+func TestInvite(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "invite", nil)
+	defer c.Close()
+
+	c.Send("INVITE Carol #TestGroup")
+	c.Sync()
+
+	if !hasCall(b, fake.Call{
+		Method: "AddParticipant",
+		ChatID: testGroup.ID,
+		UserID: testCarol.ID,
+	}) {
+		t.Errorf("expected AddParticipant call, got %v", b.Calls())
+	}
+
+	c.Send("INVITE Nobody #TestGroup")
+	c.Expect(`^:whapp-irc 401 invite Nobody :No such nick/channel$`)
+}
+
+func TestWho(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "who", nil)
+	defer c.Close()
+
+	c.Send("WHO #TestGroup")
+	c.Expect(`^:whapp-irc 352 who #TestGroup Alice whapp-irc whapp-irc Alice H :0 Alice$`)
+	c.Expect(`^:whapp-irc 352 who #TestGroup Bob whapp-irc whapp-irc Bob H :0 Bob$`)
+	c.Expect(`^:whapp-irc 315 who #TestGroup `)
+}
+
+func TestWhois(t *testing.T) {
+	b := newTestBackend()
+	b.SetCommonGroups(testAlice.ID, testGroup.ID)
+	c := connectTestClient(t, b, "whois", nil)
+	defer c.Close()
+
+	c.Send("WHOIS Alice")
+	c.Expect(`^:whapp-irc 311 whois Alice ~Alice whapp-irc \* :Alice$`)
+	c.Expect(`^:whapp-irc 319 whois Alice :#TestGroup$`)
+	c.Expect(`^:whapp-irc 318 whois Alice `)
+
+	c.Send("WHOIS #TestGroup")
+	c.Expect(`^:whapp-irc 401 whois #TestGroup `)
+}
+
+func TestPrivmsg(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "privmsg", nil)
+	defer c.Close()
+
+	c.Send("PRIVMSG Alice :hello there")
+	c.Send("PRIVMSG #TestGroup :\x01ACTION waves\x01")
+	c.Sync()
+
+	sent := b.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 sent messages, got %v", sent)
+	}
+	if sent[0] != (fake.SentMessage{ChatID: testAlice.ID, Body: "hello there"}) {
+		t.Errorf("unexpected sent message %v", sent[0])
+	}
+	if sent[1] != (fake.SentMessage{ChatID: testGroup.ID, Body: "_waves_"}) {
+		t.Errorf("unexpected sent message %v", sent[1])
+	}
+}
+
+func TestReceiveMessages(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "receive", nil)
+	defer c.Close()
+
+	b.Receive(testMessage(testPrivateChat(testAlice), testAlice, 1500000100, "hi"))
+	c.Expect(`^:Alice PRIVMSG receive :hi$`)
+
+	// a message in a group chat we haven't joined yet should join it.
+	b.Receive(testMessage(testGroup, testBob, 1500000101, "first\nsecond"))
+	c.Expect(`^:receive JOIN #TestGroup$`)
+	c.Expect(`^:Bob PRIVMSG #TestGroup :first$`)
+	c.Expect(`^:Bob PRIVMSG #TestGroup :second$`)
+
+	quoted := testMessage(testGroup, testBob, 1500000101, "first\nsecond")
+	reply := testMessage(testGroup, testAlice, 1500000102, "indeed")
+	reply.QuotedMessage = &quoted
+	b.Receive(reply)
+	c.Expect(`^:Alice PRIVMSG #TestGroup :> first \[and 1 more line\]$`)
+	c.Expect(`^:Alice PRIVMSG #TestGroup :indeed$`)
+}
+
+func TestNotifications(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "notify", nil)
+	defer c.Close()
+
+	c.Send("JOIN #TestGroup")
+	c.Expect(` 366 notify #TestGroup `)
+
+	b.Notify(testGroup, "add", testAlice.ID, testCarol.ID)
+	c.Expect(`^:Carol JOIN #TestGroup$`)
+
+	b.Notify(testGroup, "remove", testAlice.ID, testCarol.ID)
+	c.Expect(`^:Alice KICK #TestGroup Carol$`)
+
+	b.Notify(testGroup, "leave", testBob.ID, testBob.ID)
+	c.Expect(`^:Bob PART #TestGroup$`)
+
+	// being removed ourselves parts the channel, so a new message joins it
+	// again.
+	b.Notify(testGroup, "remove", testAlice.ID, testSelf.ID)
+	c.Expect(`^:Alice KICK #TestGroup notify$`)
+	b.Receive(testMessage(testGroup, testAlice, 1500000200, "welcome back"))
+	c.Expect(`^:notify JOIN #TestGroup$`)
+	c.Expect(`^:Alice PRIVMSG #TestGroup :welcome back$`)
+}
+
+func TestMedia(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "media", nil)
+	defer c.Close()
+
+	hash := base64.StdEncoding.EncodeToString([]byte("media test hash"))
+	urlHash := base64.RawURLEncoding.EncodeToString([]byte("media test hash"))
+	b.AddMedia(hash, []byte("\x89PNG\r\n\x1a\nnot really a png"))
+
+	msg := testMessage(testPrivateChat(testBob), testBob, 1500000300, "")
+	msg.Type = "image"
+	msg.IsMMS = true
+	msg.MimeType = "image/png"
+	msg.MediaFileHash = hash
+	msg.Caption = "look at this"
+	b.Receive(msg)
+
+	c.Expect(`^:Bob PRIVMSG media :http://localhost:3000/` + urlHash + `\.png\?expires=\d+&sig=[0-9a-f]+ \(24 B\) look at this$`)
+
+	if _, has := fs.GetFileByHash(hash); !has {
+		t.Errorf("expected media to be stored on the file server")
+	}
+}
+
+func TestMediaFilename(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "mediafilename", nil)
+	defer c.Close()
+
+	hash := base64.StdEncoding.EncodeToString([]byte("media filename test hash"))
+	b.AddMedia(hash, bytes.Repeat([]byte("%PDF"), 512))
+
+	msg := testMessage(testPrivateChat(testBob), testBob, 1500000350, "")
+	msg.Type = "document"
+	msg.IsMMS = true
+	msg.MimeType = "application/pdf"
+	msg.MediaFileHash = hash
+	msg.MediaFilename = "Quarterly\n  report.pdf"
+	b.Receive(msg)
+
+	c.Expect(`^:Bob PRIVMSG mediafilename :http://localhost:3000/\S+\.pdf\?\S+ \(Quarterly report\.pdf, 2\.0 KB\)$`)
+
+	f, has := fs.GetFileByHash(hash)
+	if !has {
+		t.Fatalf("expected media to be stored on the file server")
+	}
+	req := httptest.NewRequest("GET", strings.TrimPrefix(fs.URL(f), "http://localhost:3000"), nil)
+	rec := httptest.NewRecorder()
+	fs.Handler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if typ := rec.Header().Get("Content-Type"); typ != "application/pdf" {
+		t.Errorf("expected Content-Type application/pdf, got %q", typ)
+	}
+	disp := rec.Header().Get("Content-Disposition")
+	if disp != `attachment; filename*=utf-8''Quarterly%0A%20%20report.pdf` {
+		t.Errorf("unexpected Content-Disposition %q", disp)
+	}
+}
+
+func TestMediaPreview(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "mediapreview", nil)
+	defer c.Close()
+
+	encode := func(img image.Image, encoder func(io.Writer, image.Image) error) []byte {
+		var buf bytes.Buffer
+		if err := encoder(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	get := func(url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", strings.TrimPrefix(url, "http://localhost:3000"), nil)
+		rec := httptest.NewRecorder()
+		fs.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	// images get a thumbnail generated from the image itself.
+	hash := base64.StdEncoding.EncodeToString([]byte("media preview image hash"))
+	urlHash := base64.RawURLEncoding.EncodeToString([]byte("media preview image hash"))
+	b.AddMedia(hash, encode(image.NewRGBA(image.Rect(0, 0, 640, 480)), png.Encode))
+
+	msg := testMessage(testPrivateChat(testBob), testBob, 1500000360, "")
+	msg.Type = "image"
+	msg.IsMMS = true
+	msg.MimeType = "image/png"
+	msg.MediaFileHash = hash
+	b.Receive(msg)
+
+	c.Expect(`^:Bob PRIVMSG mediapreview :http://localhost:3000/preview/` + urlHash + `\.png\?expires=\d+&sig=[0-9a-f]+ \([0-9.]+ K?B\)$`)
+
+	f, has := fs.GetFileByHash(hash)
+	if !has || !f.Metadata.Thumbnail {
+		t.Fatalf("expected image to be stored with a thumbnail")
+	}
+
+	rec := get(fs.PreviewURL(f))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 for preview, got %d", rec.Code)
+	}
+	thumbnail := `<meta property="og:image" content="http://localhost:3000/thumbnail/` + urlHash + `.png?expires=`
+	if !strings.Contains(rec.Body.String(), thumbnail) {
+		t.Errorf("expected og:image tag in preview, got %s", rec.Body.String())
+	}
+
+	rec = get(fs.ThumbnailURL(f))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 for thumbnail, got %d", rec.Code)
+	}
+	config, err := jpeg.DecodeConfig(rec.Body)
+	if err != nil {
+		t.Fatalf("expected a JPEG thumbnail: %s", err)
+	} else if config.Width != 320 || config.Height != 240 {
+		t.Errorf("expected a 320x240 thumbnail, got %dx%d", config.Width, config.Height)
+	}
+
+	if rec := get("http://localhost:3000/thumbnail/" + urlHash + ".png"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected unsigned thumbnail URL to be forbidden, got %d", rec.Code)
+	}
+
+	// other media use the preview embedded in the message.
+	hash = base64.StdEncoding.EncodeToString([]byte("media preview video hash"))
+	b.AddMedia(hash, []byte("not really a video"))
+
+	msg = testMessage(testPrivateChat(testBob), testBob, 1500000370, "")
+	msg.Type = "video"
+	msg.IsMMS = true
+	msg.MimeType = "video/mp4"
+	msg.MediaFileHash = hash
+	msg.MediaData.Preview.Base64 = base64.StdEncoding.EncodeToString(
+		encode(image.NewRGBA(image.Rect(0, 0, 96, 54)), func(w io.Writer, img image.Image) error {
+			return jpeg.Encode(w, img, nil)
+		}),
+	)
+	b.Receive(msg)
+
+	c.Expect(`^:Bob PRIVMSG mediapreview :http://localhost:3000/preview/\S+ \(18 B\)$`)
+
+	if f, has := fs.GetFileByHash(hash); !has || !f.Metadata.Thumbnail {
+		t.Errorf("expected video to be stored with the embedded thumbnail")
+	} else if rec := get(fs.PreviewURL(f)); !strings.Contains(rec.Body.String(), `<meta property="og:video"`) {
+		t.Errorf("expected og:video tag in preview, got %s", rec.Body.String())
+	}
+}
+
+func TestReplay(t *testing.T) {
+	b := newTestBackend()
+
+	b.AddHistory(testMessage(testGroup, testAlice, 1500000000, "already seen"))
+	b.AddHistory(testMessage(testGroup, testAlice, 1500000010, "missed one"))
+	b.AddHistory(testMessage(testGroup, testBob, 1500000020, "missed two"))
+
+	if err := userDb.SaveItem("replay", types.User{
+		LastReceivedReceipts: map[string]int64{
+			testGroup.ID.String(): 1500000000,
+		},
+		Chats: []types.ChatListItem{
+			{Identifier: "#TestGroup", ID: testGroup.ID},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := connectTestClient(t, b, "replay", []string{"whapp-irc/replay"})
+	defer c.Close()
+
+	c.Expect(`^:replay JOIN #TestGroup$`)
+	c.Expect(`^:Alice PRIVMSG #TestGroup :missed one$`)
+	c.Expect(`^:Bob PRIVMSG #TestGroup :missed two$`)
+
+	for _, line := range c.seen {
+		if line == ":Alice PRIVMSG #TestGroup :already seen" {
+			t.Errorf("message that was already seen has been replayed")
+		}
+	}
+}
+
+func TestNoReplayWithoutCap(t *testing.T) {
+	b := newTestBackend()
+	b.AddHistory(testMessage(testGroup, testAlice, 1500000010, "missed"))
+
+	if err := userDb.SaveItem("noreplay", types.User{
+		LastReceivedReceipts: map[string]int64{
+			testGroup.ID.String(): 1500000000,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := connectTestClient(t, b, "noreplay", []string{})
+	defer c.Close()
+
+	c.Sync()
+	for _, line := range c.seen {
+		if line == ":Alice PRIVMSG #TestGroup :missed" {
+			t.Errorf("message has been replayed without whapp-irc/replay")
+		}
+	}
+}
+
+func TestLoggedOut(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "loggedout", nil)
+	defer c.Close()
+
+	b.SetLoggedIn(false)
+	c.Expect(`PRIVMSG loggedout :logged out of whatsapp$`)
+}
+
+func TestReattach(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "reattach", nil)
+
+	c.Send("JOIN #TestGroup")
+	c.Expect(` 366 reattach #TestGroup `)
+	c.Detach()
+
+	// the session should stay alive and store messages while detached.
+	b.Receive(testMessage(testPrivateChat(testAlice), testAlice, 1500000400, "are you there?"))
+	b.Receive(testMessage(testGroup, testBob, 1500000401, "anyone?"))
+
+	c = connectTestClient(t, b, "reattach", nil)
+	defer c.Close()
+
+	c.Expect(`^:reattach JOIN #TestGroup$`)
+	c.Expect(`^:Alice PRIVMSG reattach :are you there\?$`)
+	c.Expect(`^:Bob PRIVMSG #TestGroup :anyone\?$`)
+
+	b.Receive(testMessage(testGroup, testAlice, 1500000402, "welcome back"))
+	c.Expect(`^:Alice PRIVMSG #TestGroup :welcome back$`)
+}
+
+func TestReplayBatch(t *testing.T) {
+	b := newTestBackend()
+	other := whapp.Chat{
+		ID:          whapp.ID{User: "31600000002-1500000000", Server: "g.us"},
+		Name:        "Other Group",
+		Timestamp:   1500000000,
+		IsGroupChat: true,
+	}
+	b.AddChat(
+		other,
+		whapp.Participant{ID: testSelf.ID, Contact: testSelf},
+		whapp.Participant{ID: testBob.ID, IsAdmin: true, Contact: testBob},
+	)
+	c := connectTestClient(t, b, "replaybatch", []string{"batch"})
+
+	c.Send("JOIN #TestGroup")
+	c.Expect(` 366 replaybatch #TestGroup `)
+	c.Detach()
+
+	b.Receive(testMessage(testGroup, testBob, 1500000450, "first"))
+	b.Receive(testMessage(testGroup, testAlice, 1500000451, "second"))
+	b.Receive(testMessage(testPrivateChat(testAlice), testAlice, 1500000452, "private"))
+	b.Receive(testMessage(other, testBob, 1500000453, "not joined"))
+
+	c = connectTestClient(t, b, "replaybatch", []string{"batch"})
+	defer c.Close()
+
+	c.Expect(`^:whapp-irc BATCH \+1 chathistory #TestGroup$`)
+	c.Expect(`^@batch=1 :Bob PRIVMSG #TestGroup :first$`)
+	c.Expect(`^@batch=1 :Alice PRIVMSG #TestGroup :second$`)
+	c.Expect(`^:whapp-irc BATCH -1$`)
+	c.Expect(`^:whapp-irc BATCH \+2 chathistory Alice$`)
+	c.Expect(`^@batch=2 :Alice PRIVMSG replaybatch :private$`)
+	c.Expect(`^:whapp-irc BATCH -2$`)
+
+	// groups that weren't joined yet are joined before their batch starts.
+	c.Expect(`^:replaybatch JOIN #OtherGroup$`)
+	c.Expect(` 366 replaybatch #OtherGroup `)
+	c.Expect(`^:whapp-irc BATCH \+3 chathistory #OtherGroup$`)
+	c.Expect(`^@batch=3 :Bob PRIVMSG #OtherGroup :not joined$`)
+	c.Expect(`^:whapp-irc BATCH -3$`)
+
+	// live messages aren't batched.
+	b.Receive(testMessage(testGroup, testBob, 1500000454, "live"))
+	c.Expect(`^:Bob PRIVMSG #TestGroup :live$`)
+}
+
+func TestMultipleClients(t *testing.T) {
+	b := newTestBackend()
+	c1 := connectTestClient(t, b, "multi", nil)
+	c1.Send("JOIN #TestGroup")
+	c1.Expect(` 366 multi #TestGroup `)
+
+	// the second client shares the session of the first one.
+	c2 := connectTestClient(t, b, "multi", nil)
+	defer c2.Close()
+	c2.Expect(`^:multi JOIN #TestGroup$`)
+
+	b.Receive(testMessage(testGroup, testAlice, 1500000500, "hi both"))
+	c1.Expect(`^:Alice PRIVMSG #TestGroup :hi both$`)
+	c2.Expect(`^:Alice PRIVMSG #TestGroup :hi both$`)
+
+	// messages sent by one client are echoed to the others.
+	c1.Send("PRIVMSG #TestGroup :hi Alice")
+	c2.Expect(`^:multi PRIVMSG #TestGroup :hi Alice$`)
+	c1.Sync()
+	if sent := b.Sent(); len(sent) != 1 {
+		t.Errorf("expected 1 sent message, got %v", sent)
+	}
+
+	c1.Detach()
+
+	b.Receive(testMessage(testGroup, testBob, 1500000501, "still there?"))
+	c2.Expect(`^:Bob PRIVMSG #TestGroup :still there\?$`)
+}
+
+func TestCertFingerprint(t *testing.T) {
+	cert := newTestCert(t)
+	fingerprint := testCertFingerprint(cert)
+
+	// the fingerprint of an user without credentials is stored.
+	if err := userDb.SaveItem("certnew", types.User{
+		LastReceivedReceipts: map[string]int64{},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := connectTestClientTLS(t, newTestBackend(), "certnew", &cert)
+	waitFor(t, "fingerprint to be stored", func() bool {
+		var user types.User
+		found, err := userDb.GetItem("certnew", &user)
+		return err == nil && found && user.CertFingerprint == fingerprint
+	})
+	c.Close()
+
+	// a matching certificate is an alternative to PASS.
+	if err := userDb.SaveItem("cert", types.User{
+		Password:             "secret",
+		CertFingerprint:      fingerprint,
+		LastReceivedReceipts: map[string]int64{},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	c = connectTestClientTLS(t, newTestBackend(), "cert", &cert)
+	defer c.Close()
+
+	var user types.User
+	if _, err := userDb.GetItem("cert", &user); err != nil {
+		t.Fatal(err)
+	} else if !user.CheckPassword("secret") {
+		t.Errorf("expected password to be kept, got %q", user.Password)
+	}
+}
+
+func TestPassword(t *testing.T) {
+	// passwords stored in plain text by older versions are hashed.
+	if err := userDb.SaveItem("password", types.User{
+		Password:             "secret",
+		LastReceivedReceipts: map[string]int64{},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := connectTestClientAuth(t, newTestBackend(), "password", nil, func(c *testClient) {
+		c.Send("PASS secret")
+	})
+	defer c.Close()
+
+	var user types.User
+	if _, err := userDb.GetItem("password", &user); err != nil {
+		t.Fatal(err)
+	} else if user.Password == "secret" || !user.CheckPassword("secret") {
+		t.Errorf("expected password to be hashed, got %q", user.Password)
+	}
+}
+
+func TestSASL(t *testing.T) {
+	hash, err := types.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := userDb.SaveItem("sasl", types.User{
+		Password:             hash,
+		LastReceivedReceipts: map[string]int64{},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	plain := func(pass string) string {
+		return base64.StdEncoding.EncodeToString([]byte("\x00sasl\x00" + pass))
+	}
+
+	c := connectTestClientAuth(t, newTestBackend(), "sasl", []string{"sasl"}, func(c *testClient) {
+		c.Send("AUTHENTICATE PLAIN")
+		c.Expect(`^AUTHENTICATE \+$`)
+		c.Send("AUTHENTICATE " + plain("wrong"))
+		c.Expect(` 904 sasl `)
+
+		c.Send("AUTHENTICATE EXTERNAL")
+		c.Expect(` 908 sasl PLAIN `)
+		c.Expect(` 904 sasl `)
+
+		// payloads are limited in size, even when split up.
+		c.Send("AUTHENTICATE PLAIN")
+		c.Expect(`^AUTHENTICATE \+$`)
+		for i := 0; i < 21; i++ {
+			c.Send("AUTHENTICATE " + strings.Repeat("A", 400))
+		}
+		c.Expect(` 904 sasl `)
+
+		c.Send("AUTHENTICATE PLAIN")
+		c.Expect(`^AUTHENTICATE \+$`)
+		c.Send("AUTHENTICATE " + plain("secret"))
+		c.Expect(`^:whapp-irc 900 sasl sasl!sasl@whapp-irc sasl `)
+		c.Expect(` 903 sasl `)
+	})
+	defer c.Close()
+}
+
+func TestCapabilities(t *testing.T) {
+	c := connectTestClientAuth(t, newTestBackend(), "capneg", []string{"server-time"}, func(c *testClient) {
+		c.Send("CAP LS 302")
+		c.Expect(`:whapp-irc CAP capneg LS :.*\bsasl=PLAIN,EXTERNAL\b`)
+
+		c.Send("CAP REQ :whapp-irc/replay unknown-cap")
+		c.Expect(`:whapp-irc CAP capneg NAK :whapp-irc/replay unknown-cap$`)
+
+		c.Send("CAP REQ :-server-time whapp-irc/replay")
+		c.Expect(`:whapp-irc CAP capneg ACK :-server-time whapp-irc/replay$`)
+
+		c.Send("CAP LIST")
+		c.Expect(`:whapp-irc CAP capneg LIST :whapp-irc/replay$`)
+	})
+	defer c.Close()
+
+	// CAP version 302 implies cap-notify.
+	capabilities.Server.Register("whapp-irc/test", "value")
+	c.Expect(`:whapp-irc CAP capneg NEW :whapp-irc/test=value$`)
+	capabilities.Server.Unregister("whapp-irc/test")
+	c.Expect(`:whapp-irc CAP capneg DEL :whapp-irc/test$`)
+}
+
+func TestMessageTags(t *testing.T) {
+	b := newTestBackend()
+	c1 := connectTestClient(t, b, "tags", []string{"message-tags"})
+	defer c1.Close()
+	c2 := connectTestClient(t, b, "tags", []string{"message-tags"})
+	plain := connectTestClient(t, b, "tags", nil)
+
+	// client-only tags are relayed to the other clients, escaped.
+	c1.Send(`@+example=a\sb\:c;msgid=ignored TAGMSG #TestGroup`)
+	c2.Expect(`^@\+example=a\\sb\\:c :tags TAGMSG #TestGroup$`)
+
+	c1.Send(`@+example PRIVMSG Alice :tagged`)
+	c2.Expect(`^@\+example;msgid=\S+ :tags PRIVMSG Alice :tagged$`)
+	plain.Expect(`^:tags PRIVMSG Alice :tagged$`)
+
+	for _, line := range plain.seen {
+		if strings.Contains(line, "TAGMSG") {
+			t.Errorf("TAGMSG sent to client without message-tags: %s", line)
+		}
+	}
+
+	plain.Detach()
+	c2.Detach()
+}
+
+func TestMsgID(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "msgid", []string{"message-tags"})
+	defer c.Close()
+
+	msg := testMessage(testGroup, testAlice, 1500000600, "first\nsecond")
+	b.Receive(msg)
+	line := c.Expect(`^@msgid=\S+ :Alice PRIVMSG #TestGroup :first$`)
+	c.Expect(`^@msgid=\S+/1 :Alice PRIVMSG #TestGroup :second$`)
+
+	msgid := strings.TrimPrefix(strings.Fields(line)[0], "@msgid=")
+
+	sessions.mu.Lock()
+	conn := sessions.m["msgid"]
+	sessions.mu.Unlock()
+
+	found, has := conn.messageByMsgID(msgid)
+	if !has || found.Body != msg.Body {
+		t.Errorf("expected to find message by msgid %s, got %v", msgid, found)
+	}
+	if _, has := conn.messageByMsgID(msgid + "/1"); !has {
+		t.Errorf("expected to find message by msgid of its second line")
+	}
+}
+
+func TestReply(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "reply", []string{"message-tags"})
+	defer c.Close()
+
+	b.Receive(testMessage(testGroup, testAlice, 1500000700, "question?"))
+	line := c.Expect(`:Alice PRIVMSG #TestGroup :question\?$`)
+	msgid := strings.TrimPrefix(strings.Fields(line)[0], "@msgid=")
+
+	b.Receive(testMessage(testGroup, testBob, 1500000701, "another one"))
+	c.Expect(`:Bob PRIVMSG #TestGroup :another one$`)
+
+	// the fallback reply comes first, since sent messages count as recent
+	// messages as well.
+	c.Send("PRIVMSG #TestGroup :^2 fallback answer")
+	c.Send("@+draft/reply=" + msgid + " PRIVMSG #TestGroup :answer")
+	c.Send("PRIVMSG #TestGroup :^9 nothing to reply to")
+	c.Send("PRIVMSG #TestGroup :>2 quoted text")
+	c.Send("@+draft/reply=" + msgid + " PRIVMSG Alice :wrong chat")
+	c.Expect(`PRIVMSG reply :message to reply to is in another chat$`)
+	c.Sync()
+
+	sent := b.Sent()
+	if len(sent) != 4 {
+		t.Fatalf("expected 4 sent messages, got %v", sent)
+	}
+	if sent[0] != (fake.SentMessage{ChatID: testGroup.ID, Body: "fallback answer", QuotedID: msgid}) {
+		t.Errorf("unexpected sent message %v", sent[0])
+	}
+	if sent[1] != (fake.SentMessage{ChatID: testGroup.ID, Body: "answer", QuotedID: msgid}) {
+		t.Errorf("unexpected sent message %v", sent[1])
+	}
+	if sent[2] != (fake.SentMessage{ChatID: testGroup.ID, Body: "^9 nothing to reply to"}) {
+		t.Errorf("unexpected sent message %v", sent[2])
+	}
+	if sent[3] != (fake.SentMessage{ChatID: testGroup.ID, Body: ">2 quoted text"}) {
+		t.Errorf("unexpected sent message %v", sent[3])
+	}
+}
+
+func TestReactions(t *testing.T) {
+	b := newTestBackend()
+	c1 := connectTestClient(t, b, "react", []string{"message-tags"})
+	c2 := connectTestClient(t, b, "react", nil)
+	defer c2.Close()
+
+	msg := b.Receive(testMessage(testGroup, testAlice, 1500000800, "lunch?\nat noon"))
+	c1.Expect(`:Alice PRIVMSG #TestGroup :lunch\?$`)
+	c2.Expect(`:Alice PRIVMSG #TestGroup :at noon$`)
+
+	// WhatsApp -> IRC
+	b.React(whapp.Reaction{
+		MessageID: msg.ID.Serialized,
+		SenderID:  testBob.ID,
+		Reaction:  "👍",
+	})
+	c1.Expect(`^@\+draft/react=👍;\+draft/reply=` + msg.ID.Serialized + `(;\S+)? :Bob TAGMSG #TestGroup$`)
+	c2.Expect(`:Bob PRIVMSG #TestGroup :\x01ACTION reacted 👍 to: lunch\?…\x01$`)
+
+	// IRC -> WhatsApp, the other client gets the fallback.
+	c1.Send("@+draft/react=🎉;+draft/reply=" + msg.ID.Serialized + " TAGMSG #TestGroup")
+	c2.Expect(`:react PRIVMSG #TestGroup :\x01ACTION reacted 🎉 to: lunch\?…\x01$`)
+
+	c1.Send("@+draft/react=🎉;+draft/reply=unknown TAGMSG #TestGroup")
+	c1.Expect(`PRIVMSG react :err while sending reaction: message to react to not found$`)
+	c1.Send("@+draft/react=🎉;+draft/reply=" + msg.ID.Serialized + " TAGMSG Alice")
+	c1.Expect(`PRIVMSG react :err while sending reaction: message to react to is in another chat$`)
+
+	reactions := b.Reactions()
+	if len(reactions) != 1 ||
+		reactions[0].MessageID != msg.ID.Serialized ||
+		reactions[0].Reaction != "🎉" {
+		t.Fatalf("unexpected sent reactions %v", reactions)
+	}
+
+	// the reaction reported back by WhatsApp isn't sent twice.
+	b.React(reactions[0])
+	b.React(whapp.Reaction{
+		MessageID: msg.ID.Serialized,
+		SenderID:  testAlice.ID,
+		Reaction:  "❤",
+	})
+	c2.Expect(`:Alice PRIVMSG #TestGroup :\x01ACTION reacted ❤ to: lunch\?…\x01$`)
+	n := 0
+	for _, line := range c2.seen {
+		if strings.Contains(line, "reacted 🎉") {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("expected own reaction to be sent once, got %d times", n)
+	}
+
+	c1.Detach()
+}
+
+func TestChatHistory(t *testing.T) {
+	b := newTestBackend()
+
+	// messages older than the last history window aren't loaded.
+	start := time.Now().Unix() - 60
+	b.AddHistory(testMessage(testGroup, testAlice, start-2*365*24*60*60, "too old"))
+
+	var ids []string
+	for i := 0; i < 10; i++ {
+		msg := b.AddHistory(testMessage(testGroup, testAlice, start+int64(i), fmt.Sprintf("msg %d", i)))
+		ids = append(ids, msg.ID.Serialized)
+	}
+	timestamp := func(i int64) string {
+		return time.Unix(start+i, 0).UTC().Format(ircconnection.TimeFormat)
+	}
+
+	c := connectTestClient(t, b, "history", []string{"batch", "message-tags", "draft/chathistory"})
+	defer c.Close()
+
+	// history sends the given command and returns the bodies of the messages
+	// in the returned batch.
+	history := func(command string) []string {
+		c.t.Helper()
+
+		c.Send(command)
+		line := c.Expect(`BATCH \+\S+ `)
+		ref := strings.TrimPrefix(strings.Fields(line)[2], "+")
+
+		var res []string
+		for {
+			line := c.Expect(``)
+			if strings.HasSuffix(line, "BATCH -"+ref) {
+				return res
+			} else if !strings.HasPrefix(line, "@batch="+ref+";") {
+				t.Fatalf("unexpected line in batch: %s", line)
+			}
+			res = append(res, line[strings.LastIndex(line, ":")+1:])
+		}
+	}
+	expect := func(command string, expected ...string) {
+		c.t.Helper()
+
+		if res := history(command); strings.Join(res, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expected %v, got %v", command, expected, res)
+		}
+	}
+
+	expect("CHATHISTORY LATEST #TestGroup * 3", "msg 7", "msg 8", "msg 9")
+	expect("CHATHISTORY LATEST #TestGroup * 100", "msg 0", "msg 1", "msg 2", "msg 3", "msg 4", "msg 5", "msg 6", "msg 7", "msg 8", "msg 9")
+	expect("CHATHISTORY BEFORE #TestGroup msgid="+ids[5]+" 2", "msg 3", "msg 4")
+	expect("CHATHISTORY AFTER #TestGroup timestamp="+timestamp(5)+" 2", "msg 6", "msg 7")
+	expect("CHATHISTORY AROUND #TestGroup msgid="+ids[5]+" 4", "msg 3", "msg 4", "msg 6", "msg 7")
+	expect("CHATHISTORY BETWEEN #TestGroup msgid="+ids[2]+" msgid="+ids[6]+" 10", "msg 3", "msg 4", "msg 5")
+	expect("CHATHISTORY BETWEEN #TestGroup msgid="+ids[8]+" msgid="+ids[2]+" 2", "msg 6", "msg 7")
+	expect("CHATHISTORY LATEST #TestGroup msgid="+ids[7]+" 5", "msg 8", "msg 9")
+
+	expect("CHATHISTORY AFTER #TestGroup timestamp=2000-01-01T00:00:00.000Z 1", "msg 0")
+
+	c.Send("CHATHISTORY TARGETS timestamp=" + timestamp(-60) + " timestamp=" + timestamp(60) + " 10")
+	c.Expect(`BATCH \+\S+ draft/chathistory-targets$`)
+	c.Expect(`CHATHISTORY TARGETS #TestGroup ` + timestamp(9) + `$`)
+	c.Expect(`BATCH -\S+$`)
+
+	// media isn't downloaded while serving history.
+	hash := base64.StdEncoding.EncodeToString([]byte("history media hash"))
+	b.AddMedia(hash, []byte("\x89PNG\r\n\x1a\nnot really a png"))
+	media := testMessage(testGroup, testAlice, start+10, "")
+	media.Type = "image"
+	media.IsMMS = true
+	media.MimeType = "image/png"
+	media.MediaFileHash = hash
+	b.AddHistory(media)
+	expect("CHATHISTORY LATEST #TestGroup * 1", "--file--")
+	if _, has := fs.GetFileByHash(hash); has {
+		t.Errorf("expected media in history not to be downloaded")
+	}
+
+	c.Send("CHATHISTORY LATEST #Unknown * 10")
+	c.Expect(`FAIL CHATHISTORY INVALID_TARGET LATEST #Unknown :Unknown chat$`)
+	c.Send("CHATHISTORY BEFORE #TestGroup msgid=unknown 10")
+	c.Expect(`FAIL CHATHISTORY INVALID_PARAMS BEFORE #TestGroup :unknown msgid unknown$`)
+}
+
+func TestEchoMessage(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "echo", []string{"echo-message", "message-tags"})
+	defer c.Close()
+
+	c.Send("@+draft/reply=unknown PRIVMSG Alice :hello")
+	c.Expect(`PRIVMSG echo :message to reply to not found$`)
+
+	c.Send("PRIVMSG Alice :hello")
+	line := c.Expect(`^@msgid=\S+ :echo PRIVMSG Alice :hello$`)
+	msgid := strings.TrimPrefix(strings.Fields(line)[0], "@msgid=")
+	history, err := b.GetMessagesFromChatTillDate(context.Background(), testAlice.ID, 0)
+	if err != nil || len(history) == 0 || history[len(history)-1].ID.Serialized != msgid {
+		t.Errorf("echoed msgid %s isn't the id of the sent message", msgid)
+	}
+
+	// the fallback reply syntax isn't echoed, actions are echoed as is.
+	b.Receive(testMessage(testPrivateChat(testAlice), testAlice, 1500000900, "hi"))
+	c.Expect(`:Alice PRIVMSG echo :hi$`)
+	c.Send("PRIVMSG Alice :^1 hello again")
+	c.Expect(`^@msgid=\S+ :echo PRIVMSG Alice :hello again$`)
+	c.Send("PRIVMSG Alice :\x01ACTION waves\x01")
+	c.Expect(`^@msgid=\S+ :echo PRIVMSG Alice :\x01ACTION waves\x01$`)
+
+	b.FailSending(errors.New("phone offline"))
+	c.Send("PRIVMSG Alice :are you there?")
+	c.Expect(`^:whapp-irc FAIL PRIVMSG CANNOT_SEND Alice :err while sending: phone offline$`)
+}
+
+func TestReceipts(t *testing.T) {
+	b := newTestBackend()
+
+	// reset the settings saved by previous runs
+	if err := userDb.SaveItem("acks", types.User{
+		LastReceivedReceipts: map[string]int64{},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := connectTestClient(t, b, "acks", []string{"message-tags"})
+	defer c.Close()
+
+	// a message sent using the phone
+	msg := b.Receive(whapp.Message{
+		Type:       "chat",
+		Body:       "hello",
+		Sender:     &whapp.Contact{ID: testMe.SelfID, IsMe: true},
+		IsSentByMe: true,
+		Chat:       testPrivateChat(testAlice),
+	})
+	c.Expect(`^@msgid=\S+ :acks PRIVMSG Alice :hello$`)
+
+	b.SetAck(msg.ID, whapp.AckDelivered)
+	c.Expect(`^@whapp-irc/ack=delivered;whapp-irc/ack-msgid=` + msg.ID.Serialized + ` :acks TAGMSG Alice$`)
+	b.SetAck(msg.ID, whapp.AckDelivered)
+
+	c.Send("PRIVMSG status :receipts Alice notices")
+	c.Expect(`PRIVMSG acks :receipts for Alice set to notices$`)
+	b.SetAck(msg.ID, whapp.AckRead)
+	c.Expect(`^:status NOTICE acks :Alice: message "hello" read$`)
+
+	n := 0
+	for _, line := range c.seen {
+		if strings.Contains(line, "ack=delivered") {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("expected the delivered ack to be sent once, got %d times", n)
+	}
+
+	var user types.User
+	if _, err := userDb.GetItem("acks", &user); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range user.Chats {
+		if item.Identifier == "Alice" && item.Settings.Receipts != types.ReceiptsNotices {
+			t.Errorf("receipts setting hasn't been saved, got %q", item.Settings.Receipts)
+		}
+	}
+
+	c.Send("PRIVMSG status :receipts Alice off")
+	c.Expect(`PRIVMSG acks :receipts for Alice set to off$`)
+	c.Send("PRIVMSG status :receipts Alice")
+	c.Expect(`PRIVMSG acks :receipts for Alice: off$`)
+}
+
+func TestReadMarker(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "markread", []string{"draft/read-marker"})
+	defer c.Close()
+
+	c.Send("JOIN #TestGroup")
+	c.Expect(`^:whapp-irc 366 markread #TestGroup `)
+	c.Expect(`^:whapp-irc MARKREAD #TestGroup \*$`)
+
+	c.Send("MARKREAD #TestGroup timestamp=2030-01-01T12:00:00.000Z")
+	c.Expect(`^:whapp-irc MARKREAD #TestGroup timestamp=2030-01-01T12:00:00.000Z$`)
+	waitFor(t, "chat to be marked as read", func() bool {
+		return hasCall(b, fake.Call{Method: "SendSeen", ChatID: testGroup.ID})
+	})
+
+	// older markers are ignored
+	c.Send("MARKREAD #TestGroup timestamp=2029-01-01T12:00:00.000Z")
+	c.Expect(`^:whapp-irc MARKREAD #TestGroup timestamp=2030-01-01T12:00:00.000Z$`)
+	c.Send("MARKREAD #TestGroup")
+	c.Expect(`^:whapp-irc MARKREAD #TestGroup timestamp=2030-01-01T12:00:00.000Z$`)
+
+	c.Send("MARKREAD #Unknown *")
+	c.Expect(`^:whapp-irc FAIL MARKREAD INVALID_PARAMS #Unknown :Unknown chat$`)
+
+	// clients without draft/read-marker mark a chat as read by replying.
+	other := connectTestClient(t, b, "markread", nil)
+	defer other.Close()
+
+	other.Send("PRIVMSG Bob :hi")
+	waitFor(t, "chat to be marked as read after replying", func() bool {
+		return hasCall(b, fake.Call{Method: "SendSeen", ChatID: testBob.ID})
+	})
+}
+
+func TestTyping(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "typing", []string{"message-tags"})
+	defer c.Close()
+
+	b.SetChatState(whapp.ChatState{
+		ChatID:   testAlice.ID,
+		SenderID: testAlice.ID,
+		State:    whapp.ChatStateComposing,
+	})
+	c.Expect(`^@\+typing=active :Alice TAGMSG typing$`)
+
+	b.SetChatState(whapp.ChatState{
+		ChatID:   testGroup.ID,
+		SenderID: testBob.ID,
+		State:    whapp.ChatStateAvailable,
+	})
+	c.Expect(`^@\+typing=done :Bob TAGMSG #TestGroup$`)
+
+	c.Send("@+typing=active TAGMSG Alice")
+	waitFor(t, "chat state to be sent", func() bool {
+		for _, state := range b.ChatStates() {
+			if state.ChatID == testAlice.ID && state.State == whapp.ChatStateComposing {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestUpload(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n not really a png")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cat.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(png)
+		case "/page":
+			fmt.Fprint(w, "<html><body>not a file</body></html>")
+		case "/big.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(make([]byte, whapp.MaxMediaSize+1))
+		case "/redirect":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	hosts := conf.UploadHosts
+	defer func() { conf.UploadHosts = hosts }()
+
+	b := newTestBackend()
+	c := connectTestClient(t, b, "upload", nil)
+	defer c.Close()
+
+	// by default only files on the file server itself are uploaded, other
+	// ports on its host aren't connected to.
+	conf.UploadHosts = nil
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	local := "http://localhost:" + port + "/cat.png"
+	c.Send("PRIVMSG Alice :" + local)
+	waitFor(t, "link to be sent", func() bool {
+		sent := b.Sent()
+		return len(sent) == 1 && sent[0].Body == local
+	})
+	c.Send("PRIVMSG Alice :http://localhost:3000/unknown.png")
+	c.Expect(`PRIVMSG upload :err while sending: error while fetching \S+: file not found on the file server$`)
+	if len(b.SentMedia()) != 0 {
+		t.Fatalf("unexpected uploads %v", b.SentMedia())
+	}
+
+	conf.UploadHosts = []string{"127.0.0.1"}
+
+	c.Send("PRIVMSG Alice :" + srv.URL + "/cat.png look at this")
+	waitFor(t, "file to be uploaded", func() bool {
+		return len(b.SentMedia()) == 1
+	})
+	sent := b.SentMedia()[0]
+	if sent.ChatID != testAlice.ID ||
+		sent.Caption != "look at this" ||
+		sent.File.Name != "cat.png" ||
+		sent.File.MimeType != "image/png" ||
+		string(sent.File.Bytes) != string(png) {
+		t.Errorf("unexpected upload %+v", sent)
+	}
+
+	// web pages are sent as links
+	c.Send("PRIVMSG Alice :" + srv.URL + "/page")
+	waitFor(t, "link to be sent", func() bool {
+		sent := b.Sent()
+		return len(sent) == 2 && sent[1].Body == srv.URL+"/page"
+	})
+
+	c.Send("PRIVMSG Alice :" + srv.URL + "/missing.png")
+	c.Expect(`PRIVMSG upload :err while sending: error while fetching \S+/missing.png: unexpected status 404 Not Found$`)
+
+	// images larger than WhatsApp accepts aren't downloaded
+	c.Send("PRIVMSG Alice :" + srv.URL + "/big.png")
+	c.Expect(`PRIVMSG upload :err while sending: error while fetching \S+/big.png: file is larger than 16777216 bytes$`)
+
+	// redirects are only followed to allowed hosts
+	c.Send("PRIVMSG Alice :" + srv.URL + "/redirect")
+	c.Expect(`PRIVMSG upload :err while sending: error while fetching \S+/redirect: .*redirect to disallowed host 169\.254\.169\.254$`)
+
+	// and private addresses are only fetched from if they're listed
+	other := httptest.NewServer(srv.Config.Handler)
+	defer other.Close()
+	conf.UploadHosts = []string{"*"}
+	c.Send("PRIVMSG Alice :" + other.URL + "/cat.png")
+	c.Expect(`PRIVMSG upload :err while sending: error while fetching \S+/cat.png: .*refusing to connect to private address 127\.0\.0\.1 of 127\.0\.0\.1$`)
+}
+
+func TestFileHost(t *testing.T) {
+	b := newTestBackend()
+	c := connectTestClient(t, b, "filehost", nil)
+	defer c.Close()
+	c.Expect(`^:whapp-irc 005 filehost .* draft/FILEHOST=http://localhost:3000/upload `)
+
+	c.Send("PRIVMSG status :upload-token")
+	line := c.Expect(`PRIVMSG filehost :upload files to http://localhost:3000/upload using HTTP basic auth with your nick and upload token \S+$`)
+	fields := strings.Fields(line)
+	token := fields[len(fields)-1]
+
+	srv := httptest.NewServer(fs.Handler())
+	defer srv.Close()
+
+	png := []byte("\x89PNG\r\n\x1a\n uploaded")
+	upload := func(pass string) *http.Response {
+		req, err := http.NewRequest("POST", srv.URL+"/upload", strings.NewReader(string(png)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("filehost", pass)
+		req.Header.Set("Content-Type", "image/png")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	if res := upload("wrong"); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected upload with wrong token to fail, got %s", res.Status)
+	}
+	res := upload(token)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected upload to succeed, got %s", res.Status)
+	}
+	location := res.Header.Get("Location")
+	if !strings.HasPrefix(location, "http://localhost:3000/") || !strings.Contains(location, ".png?") {
+		t.Fatalf("unexpected location %s", location)
+	}
+
+	// the uploaded file is sent from the file server, without fetching it.
+	c.Send("PRIVMSG Alice :" + location)
+	waitFor(t, "uploaded file to be sent", func() bool {
+		sent := b.SentMedia()
+		return len(sent) == 1 &&
+			string(sent[0].File.Bytes) == string(png) &&
+			sent[0].File.MimeType == "image/png"
+	})
+}
@@ -73,3 +73,20 @@ func (db *Database) SaveItem(id string, item interface{}) error {
 
 	return ioutil.WriteFile(db.getPath(id), bytes, 0600)
 }
+
+// RemoveItem removes the item with the given id from the database, it's not an
+// error if there's no such item.
+func (db *Database) RemoveItem(id string) error {
+	if id == "" {
+		return ErrIDEmpty
+	}
+
+	unlock := db.lockMap.Lock(id)
+	defer unlock()
+
+	err := os.Remove(db.getPath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -7,3 +7,7 @@ var ErrHashEmpty = errors.New("hash is empty")
 
 // ErrBytesEmpty is returned when the given byte slice is empty.
 var ErrBytesEmpty = errors.New("bytes are empty")
+
+// ErrImageTooLarge is returned when an image has too many pixels to make a
+// thumbnail of.
+var ErrImageTooLarge = errors.New("image is too large")
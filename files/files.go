@@ -4,16 +4,23 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"strings"
 	"sync"
+	"time"
+	"whapp-irc/database"
 )
 
 // File represents a file on the FileServer.
 type File struct {
-	Hash string
-	Path string
-	URL  string
+	Hash     string
+	Path     string
+	URL      string
+	Metadata Metadata
+
+	id string // the name of the file without extension
 }
 
 // FileServer represents a (running) file server.
@@ -23,24 +30,55 @@ type FileServer struct {
 	UseHTTPS  bool
 	Directory string
 
+	// Authenticate checks the HTTP basic auth credentials of uploads, when
+	// it's nil uploading is disabled.
+	Authenticate func(user, pass string) bool
+	// MaxUploadSize is the maximum size in bytes of an uploaded file.
+	MaxUploadSize int64
+	// Retention is the policy used by Sweep to remove files.
+	Retention Retention
+	// URLExpiry is how long URLs returned by URL are valid, zero means
+	// forever.
+	URLExpiry time.Duration
+
+	meta *database.Database
+	key  []byte // the key used to sign URLs
+
 	mutex      sync.RWMutex
 	hashToPath map[string]File
+	idToHash   map[string]string
+	dirty      map[string]bool // hashes of files with unsaved metadata
 }
 
 // MakeFileServer returns a new FileServer in the given dir, using the given
-// options. It first scans the dir for older files, and loads them in the
-// database.
+// options. It first scans the dir for older files, and loads them and their
+// metadata in the database. The metadata is stored in db/<dir>, the key used to
+// sign URLs in db/<dir>.key.
 func MakeFileServer(host, port, dir string, useHTTPS bool) (*FileServer, error) {
+	meta, err := database.MakeDatabase("db/" + dir)
+	if err != nil {
+		return nil, err
+	}
+	key, err := loadKey("db/" + dir + ".key")
+	if err != nil {
+		return nil, err
+	}
+
 	fs := &FileServer{
 		Host:      host,
 		Port:      port,
 		UseHTTPS:  useHTTPS,
 		Directory: dir,
 
+		meta: meta,
+		key:  key,
+
 		hashToPath: make(map[string]File),
+		idToHash:   make(map[string]string),
+		dirty:      make(map[string]bool),
 	}
 
-	err := os.Mkdir("./"+dir, 0700)
+	err = os.Mkdir("./"+dir, 0700)
 	if err != nil {
 		if !os.IsExist(err) {
 			return nil, err
@@ -78,7 +116,11 @@ func MakeFileServer(host, port, dir string, useHTTPS bool) (*FileServer, error)
 			if err != nil {
 				return nil, err
 			}
+			if f.Metadata, err = fs.loadMetadata(f.id, diskFile); err != nil {
+				return nil, err
+			}
 			fs.hashToPath[hash] = f
+			fs.idToHash[f.id] = hash
 		}
 	}
 
@@ -89,12 +131,29 @@ func MakeFileServer(host, port, dir string, useHTTPS bool) (*FileServer, error)
 func (fs *FileServer) Serve() error {
 	httpServer := &http.Server{
 		Addr:    ":" + fs.Port,
-		Handler: noDirListing(http.FileServer(http.Dir(fs.Directory))),
+		Handler: fs.Handler(),
 	}
 
 	return httpServer.ListenAndServe()
 }
 
+// Handler returns the HTTP handler serving the files, their thumbnails and
+// preview pages, and accepting uploads on UploadURL.
+func (fs *FileServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	files := http.FileServer(http.Dir(fs.Directory))
+	mux.Handle("/", noDirListing(fs.checkSignature(fs.serveMetadata(files))))
+	mux.HandleFunc("/"+uploadPath, fs.handleUpload)
+	mux.Handle("/"+thumbnailPath+"/", fs.checkSignature(http.HandlerFunc(fs.serveThumbnail)))
+	mux.Handle("/"+previewPath+"/", fs.checkSignature(http.HandlerFunc(fs.servePreview)))
+	return mux
+}
+
+// UploadURL returns the URL files can be uploaded to using a POST request.
+func (fs *FileServer) UploadURL() string {
+	return fs.getURL(uploadPath)
+}
+
 func (fs *FileServer) getURL(fname string) string {
 	protocol := "http"
 	if fs.UseHTTPS {
@@ -127,12 +186,15 @@ func (fs *FileServer) makeFile(hash, ext string) (File, error) {
 		Hash: hash,
 		URL:  fs.getURL(fname),
 		Path: fmt.Sprintf("./%s/%s", fs.Directory, fname),
+
+		id: urlHash,
 	}, nil
 }
 
 // AddBlob adds the given bytes blob to the database, using the given hash and
-// extension for the file name.
-func (fs *FileServer) AddBlob(hash, ext string, bytes []byte) (File, error) {
+// extension for the file name. The owner, filename and mime type are taken
+// from meta, the other metadata is set by AddBlob.
+func (fs *FileServer) AddBlob(hash, ext string, bytes []byte, meta Metadata) (File, error) {
 	if hash == "" {
 		return File{}, ErrHashEmpty
 	} else if len(bytes) == 0 {
@@ -148,24 +210,81 @@ func (fs *FileServer) AddBlob(hash, ext string, bytes []byte) (File, error) {
 		return File{}, err
 	}
 
+	now := time.Now()
+	f.Metadata = meta
+	f.Metadata.Size = int64(len(bytes))
+	f.Metadata.Created = now
+	f.Metadata.LastAccess = now
+
+	// not all images can be decoded, those just don't get a thumbnail.
+	if strings.HasPrefix(meta.MimeType, "image/") {
+		f.Metadata.Thumbnail = fs.makeThumbnail(f, bytes) == nil
+	}
+
 	fs.mutex.Lock()
+	if existing, has := fs.hashToPath[hash]; has {
+		// keep the original owner of files added multiple times
+		f.Metadata.Created = existing.Metadata.Created
+		if existing.Metadata.Owner != "" {
+			f.Metadata.Owner = existing.Metadata.Owner
+		}
+		f.Metadata.Thumbnail = f.Metadata.Thumbnail || existing.Metadata.Thumbnail
+	}
 	fs.hashToPath[hash] = f
+	fs.idToHash[f.id] = hash
+	delete(fs.dirty, hash)
 	fs.mutex.Unlock()
 
+	if err := fs.meta.SaveItem(f.id, f.Metadata); err != nil {
+		return File{}, err
+	}
+
 	return f, nil
 }
 
 // RemoveFile removes the file from disk matching the given file struct.
 func (fs *FileServer) RemoveFile(file File) error {
-	if err := os.Remove(file.Path); err != nil {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.removeFileLocked(file)
+}
+
+// removeFileLocked removes the given file, fs.mutex must be held. A file that
+// is already gone from disk is removed as well.
+func (fs *FileServer) removeFileLocked(file File) error {
+	if err := os.Remove(file.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(fs.thumbnailFile(file)); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
-	fs.mutex.Lock()
 	delete(fs.hashToPath, file.Hash)
-	fs.mutex.Unlock()
+	delete(fs.idToHash, file.id)
+	delete(fs.dirty, file.Hash)
+
+	return fs.meta.RemoveItem(file.id)
+}
+
+// GetFileByURL returns the File struct matching the given signed URL, as
+// returned by URL. has is false if the signature is invalid or expired.
+func (fs *FileServer) GetFileByURL(rawurl string) (file File, has bool) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return File{}, false
+	}
+	query := u.Query()
+	u.RawQuery = ""
+
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
 
-	return nil
+	for _, f := range fs.hashToPath {
+		if f.URL == u.String() && fs.verify(path.Base(f.Path), query) == nil {
+			return f, true
+		}
+	}
+	return File{}, false
 }
 
 // GetFileByHash returns the File struct matching the given hash.
@@ -0,0 +1,204 @@
+package files
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	code, err := func() (int, error) {
+		dir, err := ioutil.TempDir("", "whapp-irc-files-test")
+		if err != nil {
+			return 0, err
+		}
+		defer os.RemoveAll(dir)
+
+		// the file server uses paths relative to the working directory.
+		if err := os.Chdir(dir); err != nil {
+			return 0, err
+		}
+		return m.Run(), nil
+	}()
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(code)
+}
+
+func TestThumbnailTooLarge(t *testing.T) {
+	fs, err := MakeFileServer("localhost", "3000", "thumbnails", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the header of this image claims it's 100000x100000, which would take
+	// tens of gigabytes to decode.
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	huge := buf.Bytes()
+	binary.BigEndian.PutUint32(huge[16:], 100000)
+	binary.BigEndian.PutUint32(huge[20:], 100000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+
+	hash := base64.StdEncoding.EncodeToString([]byte("huge"))
+	f, err := fs.AddBlob(hash, "png", huge, Metadata{MimeType: "image/png"})
+	if err != nil {
+		t.Fatal(err)
+	} else if f.Metadata.Thumbnail {
+		t.Error("expected no thumbnail for a huge image")
+	}
+
+	if err := fs.makeThumbnail(f, huge); err != ErrImageTooLarge {
+		t.Errorf("expected ErrImageTooLarge, got %v", err)
+	}
+}
+
+func TestMediaRetention(t *testing.T) {
+	server, err := MakeFileServer("localhost", "3000", "retention", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hash returns the base64 hash used for the file with the given name.
+	hash := func(name string) string {
+		return base64.StdEncoding.EncodeToString([]byte(name))
+	}
+	add := func(owner, name string) File {
+		f, err := server.AddBlob(hash(name), "txt", []byte("0123456789"), Metadata{Owner: owner})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	a1 := add("alice", "a1")
+	add("alice", "a2")
+	add("bob", "b1")
+
+	// accessing a1 makes a2 the least recently used file.
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, httptest.NewRequest("GET", strings.TrimPrefix(server.URL(a1), "http://localhost:3000"), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected file to be served, got %d", rec.Code)
+	}
+
+	server.Retention = Retention{UserQuota: 15, MaxSize: 10}
+	removed, err := server.Sweep(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for _, f := range removed {
+		hashes = append(hashes, f.Hash)
+	}
+	if strings.Join(hashes, ",") != hash("a2")+","+hash("b1") {
+		t.Errorf("expected a2 and b1 to be removed, got %v", hashes)
+	}
+
+	// the metadata survives restarts
+	server, err = MakeFileServer("localhost", "3000", "retention", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, has := server.GetFileByHash(hash("a1"))
+	if !has {
+		t.Fatal("expected a1 to be kept")
+	} else if _, has := server.GetFileByHash(hash("a2")); has {
+		t.Error("expected a2 to be removed")
+	}
+	if f.Metadata.Owner != "alice" ||
+		f.Metadata.Size != 10 ||
+		!f.Metadata.LastAccess.After(a1.Metadata.LastAccess) {
+		t.Errorf("unexpected metadata %+v", f.Metadata)
+	}
+
+	server.Retention = Retention{MaxAge: time.Hour}
+	if removed, err := server.Sweep(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	} else if len(removed) != 1 {
+		t.Errorf("expected a1 to expire, removed %d files", len(removed))
+	}
+}
+
+func TestSweepMissingFile(t *testing.T) {
+	server, err := MakeFileServer("localhost", "3000", "missing", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := base64.StdEncoding.EncodeToString([]byte("missing"))
+	f, err := server.AddBlob(hash, "txt", []byte("gone"), Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a file removed from disk by someone else is forgotten.
+	if err := os.Remove(f.Path); err != nil {
+		t.Fatal(err)
+	}
+	server.Retention = Retention{MaxAge: time.Hour}
+	if removed, err := server.Sweep(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	} else if len(removed) != 1 {
+		t.Errorf("expected the missing file to be removed, removed %d files", len(removed))
+	}
+	if _, has := server.GetFileByHash(hash); has {
+		t.Error("expected the missing file to be forgotten")
+	}
+}
+
+func TestSignedURLs(t *testing.T) {
+	server, err := MakeFileServer("localhost", "3000", "signed", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := base64.StdEncoding.EncodeToString([]byte("signed"))
+	f, err := server.AddBlob(hash, "txt", []byte("private"), Metadata{Owner: "signed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(server *FileServer, url string) int {
+		rec := httptest.NewRecorder()
+		path := strings.TrimPrefix(url, "http://localhost:3000")
+		server.Handler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+
+	signed := server.URL(f)
+	if code := get(server, f.URL); code != http.StatusForbidden {
+		t.Errorf("expected unsigned URL to be forbidden, got %d", code)
+	}
+	if code := get(server, signed+"0"); code != http.StatusForbidden {
+		t.Errorf("expected URL with wrong signature to be forbidden, got %d", code)
+	}
+	if code := get(server, signed); code != http.StatusOK {
+		t.Errorf("expected signed URL to be served, got %d", code)
+	}
+
+	// the signing key survives restarts
+	restarted, err := MakeFileServer("localhost", "3000", "signed", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get(restarted, signed); code != http.StatusOK {
+		t.Errorf("expected signed URL to be served after restart, got %d", code)
+	}
+
+	server.URLExpiry = -time.Minute
+	if code := get(server, server.URL(f)); code != http.StatusGone {
+		t.Errorf("expected expired URL to be gone, got %d", code)
+	}
+}
@@ -0,0 +1,219 @@
+package files
+
+import (
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Metadata contains information about a stored file, used to serve it and to
+// decide which files to remove. It's persisted in the metadata database.
+type Metadata struct {
+	Owner      string    `json:"owner,omitempty"`
+	Size       int64     `json:"size"`
+	Created    time.Time `json:"created"`
+	LastAccess time.Time `json:"lastAccess"`
+
+	// Filename and MimeType are the original name and type of the file, if
+	// known.
+	Filename string `json:"filename,omitempty"`
+	MimeType string `json:"mimeType,omitempty"`
+	// Thumbnail is whether or not a thumbnail of the file has been stored.
+	Thumbnail bool `json:"thumbnail,omitempty"`
+}
+
+// Retention is a policy for removing stored files, zero values mean there's no
+// limit.
+type Retention struct {
+	// MaxAge is the maximum time since a file has been added.
+	MaxAge time.Duration
+	// MaxSize is the maximum total size in bytes of all files.
+	MaxSize int64
+	// UserQuota is the maximum total size in bytes of the files owned by a
+	// single user.
+	UserQuota int64
+}
+
+// loadMetadata returns the stored metadata of the file with the given id, or
+// creates it using the given information of the file on disk.
+func (fs *FileServer) loadMetadata(id string, info os.FileInfo) (Metadata, error) {
+	var meta Metadata
+	found, err := fs.meta.GetItem(id, &meta)
+	if err != nil {
+		return Metadata{}, err
+	} else if found {
+		return meta, nil
+	}
+
+	meta = Metadata{
+		Size:       info.Size(),
+		Created:    info.ModTime(),
+		LastAccess: info.ModTime(),
+	}
+	return meta, fs.meta.SaveItem(id, meta)
+}
+
+// serveMetadata updates the last access time of the files served by handler,
+// and sets the Content-Type and Content-Disposition headers from their
+// metadata. The metadata is saved on the next Sweep.
+func (fs *FileServer) serveMetadata(handler http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := path.Base(path.Clean(r.URL.Path))
+		if i := strings.LastIndexByte(id, '.'); i != -1 {
+			id = id[:i]
+		}
+
+		fs.mutex.Lock()
+		hash, has := fs.idToHash[id]
+		f := fs.hashToPath[hash]
+		if has {
+			f.Metadata.LastAccess = time.Now()
+			fs.hashToPath[hash] = f
+			fs.dirty[hash] = true
+		}
+		fs.mutex.Unlock()
+
+		if has {
+			setContentHeaders(w.Header(), f.Metadata)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// setContentHeaders sets the Content-Type and Content-Disposition headers for
+// a file with the given metadata. Only images, videos and audio are shown
+// inline, other files are downloaded.
+func setContentHeaders(header http.Header, meta Metadata) {
+	disposition := "attachment"
+	if typ := meta.MimeType; typ != "" {
+		header.Set("Content-Type", typ)
+
+		switch strings.SplitN(typ, "/", 2)[0] {
+		case "image", "video", "audio":
+			disposition = "inline"
+		}
+	}
+
+	var params map[string]string
+	if meta.Filename != "" {
+		params = map[string]string{"filename": meta.Filename}
+	}
+	if value := mime.FormatMediaType(disposition, params); value != "" {
+		header.Set("Content-Disposition", value)
+	}
+}
+
+// Sweep removes the files added longer than the maximum age of the retention
+// policy ago. After that the least recently used files are removed until the
+// files of every user fit in the quota, and all files fit in the maximum size.
+// It returns the removed files.
+func (fs *FileServer) Sweep(now time.Time) ([]File, error) {
+	var res error
+	setErr := func(err error) {
+		if err != nil && res == nil {
+			res = err
+		}
+	}
+
+	fs.mutex.Lock()
+	files := make([]File, 0, len(fs.hashToPath))
+	var dirty []File
+	for hash, f := range fs.hashToPath {
+		files = append(files, f)
+		if fs.dirty[hash] {
+			dirty = append(dirty, f)
+		}
+	}
+	fs.dirty = make(map[string]bool)
+	fs.mutex.Unlock()
+
+	for _, f := range dirty {
+		setErr(fs.meta.SaveItem(f.id, f.Metadata))
+	}
+
+	// least recently used first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Metadata.LastAccess.Before(files[j].Metadata.LastAccess)
+	})
+
+	var remove []File
+	keep := files[:0]
+	for _, f := range files {
+		if fs.Retention.MaxAge > 0 && now.Sub(f.Metadata.Created) > fs.Retention.MaxAge {
+			remove = append(remove, f)
+		} else {
+			keep = append(keep, f)
+		}
+	}
+
+	if fs.Retention.UserQuota > 0 {
+		usage := make(map[string]int64)
+		for _, f := range keep {
+			usage[f.Metadata.Owner] += f.Metadata.Size
+		}
+
+		kept := keep[:0]
+		for _, f := range keep {
+			owner := f.Metadata.Owner
+			if owner != "" && usage[owner] > fs.Retention.UserQuota {
+				remove = append(remove, f)
+				usage[owner] -= f.Metadata.Size
+			} else {
+				kept = append(kept, f)
+			}
+		}
+		keep = kept
+	}
+
+	if fs.Retention.MaxSize > 0 {
+		var total int64
+		for _, f := range keep {
+			total += f.Metadata.Size
+		}
+
+		for _, f := range keep {
+			if total <= fs.Retention.MaxSize {
+				break
+			}
+			remove = append(remove, f)
+			total -= f.Metadata.Size
+		}
+	}
+
+	var removed []File
+	for _, f := range remove {
+		fs.mutex.Lock()
+		// the file might have been accessed or added again since we looked.
+		current, has := fs.hashToPath[f.Hash]
+		if has &&
+			current.Metadata.Created.Equal(f.Metadata.Created) &&
+			current.Metadata.LastAccess.Equal(f.Metadata.LastAccess) {
+			if err := fs.removeFileLocked(f); err != nil {
+				setErr(err)
+			} else {
+				removed = append(removed, f)
+			}
+		}
+		fs.mutex.Unlock()
+	}
+
+	return removed, res
+}
+
+// SweepEvery calls Sweep every interval, forever.
+func (fs *FileServer) SweepEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		removed, err := fs.Sweep(time.Now())
+		if err != nil {
+			log.Printf("error while removing old files: %s", err)
+		}
+		if len(removed) > 0 {
+			log.Printf("removed %d old files", len(removed))
+		}
+	}
+}
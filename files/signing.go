@@ -0,0 +1,110 @@
+package files
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// ErrInvalidSignature is returned when the signature of a file URL is missing
+// or incorrect.
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// ErrExpired is returned when a signed file URL has expired.
+var ErrExpired = errors.New("link expired")
+
+// loadKey reads the key used for signing URLs from the given path, generating
+// and storing a new one if there isn't one yet.
+func loadKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err == nil && len(key) > 0 {
+		return key, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, ioutil.WriteFile(path, key, 0600)
+}
+
+// sign returns the signature of the file with the given name, valid until the
+// given unix timestamp. 0 means the signature never expires.
+func (fs *FileServer) sign(fname string, expires int64) string {
+	mac := hmac.New(sha256.New, fs.key)
+	mac.Write([]byte(fname + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns the signed URL of the given file, which expires after
+// URLExpiry.
+func (fs *FileServer) URL(f File) string {
+	return f.URL + "?" + fs.signedQuery(f)
+}
+
+// signedQuery returns the query string with the signature of the given file,
+// which is also valid for its thumbnail and preview page.
+func (fs *FileServer) signedQuery(f File) string {
+	var expires int64
+	if fs.URLExpiry != 0 {
+		expires = time.Now().Add(fs.URLExpiry).Unix()
+	}
+
+	fname := path.Base(f.Path)
+	query := url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {fs.sign(fname, expires)},
+	}
+	return query.Encode()
+}
+
+// verify checks the signature in the given query of a link to the file with
+// the given name.
+func (fs *FileServer) verify(fname string, query url.Values) error {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	sig, err := hex.DecodeString(query.Get("sig"))
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	expected, _ := hex.DecodeString(fs.sign(fname, expires))
+	if !hmac.Equal(sig, expected) {
+		return ErrInvalidSignature
+	}
+
+	if expires != 0 && time.Now().Unix() > expires {
+		return ErrExpired
+	}
+	return nil
+}
+
+// checkSignature only lets requests with a valid signed URL through to the
+// given handler.
+func (fs *FileServer) checkSignature(handler http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fname := path.Base(path.Clean(r.URL.Path))
+
+		switch err := fs.verify(fname, r.URL.Query()); err {
+		case nil:
+			handler.ServeHTTP(w, r)
+		case ErrExpired:
+			http.Error(w, err.Error(), http.StatusGone)
+		default:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		}
+	})
+}
@@ -0,0 +1,193 @@
+package files
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"whapp-irc/util"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// thumbnailPath is the path of the thumbnails, both on disk relative to
+	// the directory of the file server and in URLs.
+	thumbnailPath = "thumbnail"
+	// previewPath is the path of the preview pages in URLs.
+	previewPath = "preview"
+	// thumbnailSize is the maximum width and height of a thumbnail.
+	thumbnailSize = 320
+	// maxThumbnailPixels is the maximum amount of pixels of an image we make
+	// a thumbnail of, since decoding it takes memory for every pixel.
+	maxThumbnailPixels = 50 * 1000 * 1000
+)
+
+// previewTemplate is the HTML page showing a file, with OpenGraph tags so
+// clients can show a preview of the link.
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<meta property="og:type" content="website">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.PageURL}}">
+{{- with .ThumbnailURL}}
+<meta property="og:image" content="{{.}}">
+<meta property="og:image:type" content="image/jpeg">
+<meta name="twitter:card" content="summary_large_image">
+{{- end}}
+{{- if eq .Kind "video"}}
+<meta property="og:video" content="{{.URL}}">
+<meta property="og:video:type" content="{{.MimeType}}">
+{{- end}}
+<style>body { margin: 2em auto; max-width: 60em; font-family: sans-serif; text-align: center; } img, video { max-width: 100%; }</style>
+</head>
+<body>
+{{- if eq .Kind "image"}}
+<p><img src="{{.URL}}" alt="{{.Title}}"></p>
+{{- else if eq .Kind "video"}}
+<p><video src="{{.URL}}"{{with .ThumbnailURL}} poster="{{.}}"{{end}} controls></video></p>
+{{- else if eq .Kind "audio"}}
+<p><audio src="{{.URL}}" controls></audio></p>
+{{- end}}
+<p><a href="{{.URL}}">{{.Title}}</a> ({{.Description}})</p>
+</body>
+</html>
+`))
+
+// thumbnailFile returns the path on disk of the thumbnail of the given file.
+func (fs *FileServer) thumbnailFile(f File) string {
+	return fmt.Sprintf("./%s/%s/%s.jpg", fs.Directory, thumbnailPath, f.id)
+}
+
+// makeThumbnail stores a JPEG thumbnail of the given file, made from the given
+// image bytes.
+func (fs *FileServer) makeThumbnail(f File, data []byte) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	} else if int64(config.Width)*int64(config.Height) > maxThumbnailPixels {
+		return ErrImageTooLarge
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	img = imaging.Fit(img, thumbnailSize, thumbnailSize, imaging.Lanczos)
+
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, img, imaging.JPEG, imaging.JPEGQuality(85)); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(fs.thumbnailFile(f)), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fs.thumbnailFile(f), buf.Bytes(), 0644)
+}
+
+// AddThumbnail stores a thumbnail of the given file, made from the given image
+// bytes, for example the preview embedded in a WhatsApp message.
+func (fs *FileServer) AddThumbnail(f File, image []byte) (File, error) {
+	if err := fs.makeThumbnail(f, image); err != nil {
+		return File{}, err
+	}
+
+	fs.mutex.Lock()
+	if existing, has := fs.hashToPath[f.Hash]; has {
+		f = existing
+	}
+	f.Metadata.Thumbnail = true
+	fs.hashToPath[f.Hash] = f
+	fs.mutex.Unlock()
+
+	return f, fs.meta.SaveItem(f.id, f.Metadata)
+}
+
+// ThumbnailURL returns the signed URL of the thumbnail of the given file, which
+// expires after URLExpiry.
+func (fs *FileServer) ThumbnailURL(f File) string {
+	return fs.getURL(thumbnailPath+"/"+path.Base(f.Path)) + "?" + fs.signedQuery(f)
+}
+
+// PreviewURL returns the signed URL of the preview page of the given file,
+// which expires after URLExpiry.
+func (fs *FileServer) PreviewURL(f File) string {
+	return fs.getURL(previewPath+"/"+path.Base(f.Path)) + "?" + fs.signedQuery(f)
+}
+
+// fileByRequest returns the file the given request for its thumbnail or
+// preview page is about.
+func (fs *FileServer) fileByRequest(r *http.Request) (File, bool) {
+	id := path.Base(path.Clean(r.URL.Path))
+	if i := strings.LastIndexByte(id, '.'); i != -1 {
+		id = id[:i]
+	}
+
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	hash, has := fs.idToHash[id]
+	if !has {
+		return File{}, false
+	}
+	return fs.hashToPath[hash], true
+}
+
+// serveThumbnail serves the thumbnails of files.
+func (fs *FileServer) serveThumbnail(w http.ResponseWriter, r *http.Request) {
+	f, has := fs.fileByRequest(r)
+	if !has || !f.Metadata.Thumbnail {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, fs.thumbnailFile(f))
+}
+
+// servePreview serves the preview pages of files, linking to the file and its
+// thumbnail using the signature of the request.
+func (fs *FileServer) servePreview(w http.ResponseWriter, r *http.Request) {
+	f, has := fs.fileByRequest(r)
+	if !has {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := "?" + r.URL.Query().Encode()
+	data := struct {
+		Title, Description, Kind, MimeType string
+		URL, PageURL, ThumbnailURL         string
+	}{
+		Title:       f.Metadata.Filename,
+		Description: util.FormatSize(f.Metadata.Size),
+		Kind:        strings.SplitN(f.Metadata.MimeType, "/", 2)[0],
+		MimeType:    f.Metadata.MimeType,
+		URL:         f.URL + query,
+		PageURL:     fs.getURL(previewPath+"/"+path.Base(f.Path)) + query,
+	}
+	if data.Title == "" {
+		data.Title = path.Base(f.Path)
+	}
+	if f.Metadata.MimeType != "" {
+		data.Description = f.Metadata.MimeType + ", " + data.Description
+	}
+	if f.Metadata.Thumbnail {
+		data.ThumbnailURL = fs.getURL(thumbnailPath+"/"+path.Base(f.Path)) + query
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := previewTemplate.Execute(w, data); err != nil {
+		http.Error(w, "error while rendering preview", http.StatusInternalServerError)
+	}
+}
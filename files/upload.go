@@ -0,0 +1,120 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"whapp-irc/util"
+)
+
+// uploadPath is the path of the upload endpoint, relative to the root of the
+// file server.
+const uploadPath = "upload"
+
+// handleUpload stores the body of an authenticated POST request as a new file,
+// and responds with its URL.
+func (fs *FileServer) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if fs.Authenticate == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Allow", "OPTIONS, POST")
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "OPTIONS, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok || !fs.Authenticate(user, pass) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="whapp-irc"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if fs.MaxUploadSize > 0 && r.ContentLength > fs.MaxUploadSize {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	body := io.Reader(r.Body)
+	if fs.MaxUploadSize > 0 {
+		body = io.LimitReader(r.Body, fs.MaxUploadSize+1)
+	}
+	bytes, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, "error while reading file", http.StatusBadRequest)
+		return
+	} else if fs.MaxUploadSize > 0 && int64(len(bytes)) > fs.MaxUploadSize {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	meta := uploadMetadata(r, bytes)
+	meta.Owner = user
+	sum := sha256.Sum256(bytes)
+	f, err := fs.AddBlob(
+		base64.StdEncoding.EncodeToString(sum[:]),
+		uploadExtension(meta, bytes),
+		bytes,
+		meta,
+	)
+	if err == ErrBytesEmpty {
+		http.Error(w, "file is empty", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "error while storing file", http.StatusInternalServerError)
+		return
+	}
+
+	url := fs.URL(f)
+	w.Header().Set("Location", url)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, url)
+}
+
+// uploadMetadata returns the metadata of the file uploaded in the given
+// request, using the file name given in the Content-Disposition header and the
+// Content-Type header or the contents of the file.
+func uploadMetadata(r *http.Request, bytes []byte) Metadata {
+	var meta Metadata
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition"))
+	if err == nil && params["filename"] != "" {
+		meta.Filename = filepath.Base(params["filename"])
+	}
+
+	meta.MimeType, _, err = mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || meta.MimeType == "application/octet-stream" {
+		meta.MimeType, _, _ = mime.ParseMediaType(http.DetectContentType(bytes))
+	}
+
+	return meta
+}
+
+// uploadExtension returns the extension for an uploaded file with the given
+// metadata, using its file name or its type.
+func uploadExtension(meta Metadata, bytes []byte) string {
+	if ext := filepath.Ext(meta.Filename); len(ext) > 1 && isAlphanumeric(ext[1:]) {
+		return ext[1:]
+	}
+	return util.GetExtensionByMimeOrBytes(meta.MimeType, bytes)
+}
+
+func isAlphanumeric(str string) bool {
+	for _, c := range str {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"whapp-irc/config"
+	"whapp-irc/database"
+	"whapp-irc/files"
+	"whapp-irc/maps"
+	"whapp-irc/whapp"
+	"whapp-irc/whapp/fake"
+)
+
+const testTimeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	code, err := func() (int, error) {
+		dir, err := ioutil.TempDir("", "whapp-irc-test")
+		if err != nil {
+			return 0, err
+		}
+		defer os.RemoveAll(dir)
+
+		// the file server and database use paths relative to the working
+		// directory.
+		if err := os.Chdir(dir); err != nil {
+			return 0, err
+		}
+
+		conf = config.Config{
+			FileServerHost: "localhost",
+			FileServerPort: "3000",
+			IRCPort:        "6060",
+			LogLevel:       whapp.LogLevelNormal,
+			MapProvider:    maps.GoogleMaps,
+		}
+
+		userDb, err = database.MakeDatabase("db/users")
+		if err != nil {
+			return 0, err
+		}
+
+		fs, err = files.MakeFileServer("localhost", "3000", "files", false)
+		if err != nil {
+			return 0, err
+		}
+		fs.Authenticate = authenticateUpload
+		fs.MaxUploadSize = maxUploadSize
+
+		if os.Getenv("WHAPP_IRC_TEST_LOG") == "" {
+			log.SetOutput(ioutil.Discard)
+		}
+
+		return m.Run(), nil
+	}()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(code)
+}
+
+var (
+	testMe = whapp.Me{
+		SelfID:   whapp.ID{User: "31600000000", Server: "c.us"},
+		Pushname: "Me",
+	}
+
+	testSelf  = testContact("31600000000", "Me", true)
+	testAlice = testContact("31600000001", "Alice", false)
+	testBob   = testContact("31600000002", "Bob", false)
+	testCarol = testContact("31600000003", "Carol", false)
+
+	testGroup = whapp.Chat{
+		ID:          whapp.ID{User: "31600000001-1500000000", Server: "g.us"},
+		Name:        "Test Group",
+		Timestamp:   1500000000,
+		IsGroupChat: true,
+	}
+)
+
+func testContact(user, name string, isMe bool) whapp.Contact {
+	return whapp.Contact{
+		ID:            whapp.ID{User: user, Server: "c.us"},
+		FormattedName: name,
+		IsMe:          isMe,
+	}
+}
+
+func testPrivateChat(contact whapp.Contact) whapp.Chat {
+	return whapp.Chat{
+		ID:        contact.ID,
+		Timestamp: 1500000000,
+		Contact:   contact,
+	}
+}
+
+// newTestBackend returns a fake backend containing a group chat with Alice
+// (super admin), Bob and the user (admin), and private chats with Alice, Bob
+// and Carol.
+func newTestBackend() *fake.Backend {
+	b := fake.New(testMe)
+
+	b.AddChat(
+		testGroup,
+		whapp.Participant{ID: testSelf.ID, IsAdmin: true, Contact: testSelf},
+		whapp.Participant{ID: testAlice.ID, IsAdmin: true, IsSuperAdmin: true, Contact: testAlice},
+		whapp.Participant{ID: testBob.ID, Contact: testBob},
+	)
+	b.AddChat(testPrivateChat(testAlice))
+	b.AddChat(testPrivateChat(testBob))
+	b.AddChat(testPrivateChat(testCarol))
+
+	return b
+}
+
+// testMessage returns a text message sent by from in the given chat.
+func testMessage(chat whapp.Chat, from whapp.Contact, timestamp int64, body string) whapp.Message {
+	return whapp.Message{
+		Type:      "chat",
+		Timestamp: timestamp,
+		Sender:    &from,
+		From:      from.ID,
+		Body:      body,
+		Chat:      chat,
+	}
+}
+
+// A testClient is an IRC client connected to a bridge using the fake backend.
+type testClient struct {
+	t    *testing.T
+	nick string
+
+	conn  net.Conn
+	lines chan string
+	seen  []string
+	pos   int // index in seen to start searching from in Expect
+	done  chan error
+}
+
+// connectTestClient connects a new IRC client with the given nick to a bridge
+// using the given backend. If caps is not nil, capabilities negotiation is
+// performed requesting caps. It returns after the bridge reported to be ready.
+func connectTestClient(t *testing.T, b whapp.Backend, nick string, caps []string) *testClient {
+	server, client := net.Pipe()
+	return connectTestClientConn(t, b, nick, caps, nil, server, client)
+}
+
+// connectTestClientAuth is connectTestClient, calling auth to authenticate
+// after the nick has been sent, but before negotiation has finished.
+func connectTestClientAuth(
+	t *testing.T,
+	b whapp.Backend,
+	nick string,
+	caps []string,
+	auth func(c *testClient),
+) *testClient {
+	server, client := net.Pipe()
+	return connectTestClientConn(t, b, nick, caps, auth, server, client)
+}
+
+// connectTestClientTLS is connectTestClient over TLS, using the given client
+// certificate, if any.
+func connectTestClientTLS(t *testing.T, b whapp.Backend, nick string, cert *tls.Certificate) *testClient {
+	serverCert := newTestCert(t)
+	server, client := net.Pipe()
+
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		clientConfig.Certificates = []tls.Certificate{*cert}
+	}
+
+	return connectTestClientConn(
+		t,
+		b,
+		nick,
+		nil,
+		nil,
+		tls.Server(server, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequestClientCert,
+		}),
+		tls.Client(client, clientConfig),
+	)
+}
+
+// newTestCert returns a new self-signed certificate.
+func newTestCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "whapp-irc test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+// testCertFingerprint returns the fingerprint of the given certificate, as
+// stored in the database.
+func testCertFingerprint(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// connectTestClientConn is connectTestClient using the given ends of a
+// connection.
+func connectTestClientConn(
+	t *testing.T,
+	b whapp.Backend,
+	nick string,
+	caps []string,
+	auth func(c *testClient),
+	server, client net.Conn,
+) *testClient {
+	startBackend = func(ctx context.Context, conn *Connection) (whapp.Backend, error) {
+		return b, nil
+	}
+
+	c := &testClient{
+		t:    t,
+		nick: nick,
+
+		conn:  client,
+		lines: make(chan string, 1024),
+		done:  make(chan error, 1),
+	}
+
+	go func() {
+		c.done <- BindSocket(server)
+	}()
+
+	go func() {
+		defer close(c.lines)
+
+		scanner := bufio.NewScanner(client)
+		for scanner.Scan() {
+			c.lines <- strings.TrimRight(scanner.Text(), "\r")
+		}
+	}()
+
+	// make sure the bridge is listening before we send our nick.
+	c.Send("PING :sync")
+	c.Expect(`PONG whapp-irc :sync$`)
+
+	if caps != nil {
+		c.Send("CAP LS 302")
+		c.Expect(`CAP \* LS`)
+		if len(caps) > 0 {
+			c.Send("CAP REQ :" + strings.Join(caps, " "))
+			c.Expect(`CAP \* ACK`)
+		}
+	}
+	c.Send("NICK " + nick)
+	c.Send(fmt.Sprintf("USER %s 0 * :%s", nick, nick))
+	if auth != nil {
+		auth(c)
+	}
+	if caps != nil {
+		c.Send("CAP END")
+	}
+
+	c.Expect(` 001 ` + nick + ` `)
+
+	// lines sent during setup, such as replayed messages, should still be
+	// available for Expect.
+	pos := c.pos
+	c.Expect(`PRIVMSG ` + nick + ` :ready for new messages$`)
+	c.pos = pos
+
+	return c
+}
+
+// Send sends the given raw line to the bridge.
+func (c *testClient) Send(line string) {
+	c.t.Helper()
+
+	c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		c.t.Fatalf("error while sending %q: %s", line, err)
+	}
+}
+
+// Expect returns the first line after the previously expected line that
+// matches the given regular expression, reading new lines if needed. It fails
+// the test on timeout.
+func (c *testClient) Expect(pattern string) string {
+	c.t.Helper()
+
+	re := regexp.MustCompile(pattern)
+	timeout := time.After(testTimeout)
+
+	for i := c.pos; i < len(c.seen); i++ {
+		if re.MatchString(c.seen[i]) {
+			c.pos = i + 1
+			return c.seen[i]
+		}
+	}
+
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				c.t.Fatalf("connection closed while waiting for %q, got:\n%s", pattern, strings.Join(c.seen, "\n"))
+			}
+
+			c.seen = append(c.seen, line)
+			if re.MatchString(line) {
+				c.pos = len(c.seen)
+				return line
+			}
+
+		case <-timeout:
+			c.t.Fatalf("timeout while waiting for %q, got:\n%s", pattern, strings.Join(c.seen, "\n"))
+		}
+	}
+}
+
+// Sync makes sure that all commands previously sent have been handled by the
+// bridge.
+func (c *testClient) Sync() {
+	c.t.Helper()
+
+	// WHO on an unknown target is handled in order with the other commands and
+	// only writes a 315.
+	c.Send("WHO sync")
+	c.Expect(` 315 ` + c.nick + ` sync `)
+}
+
+// Close disconnects the client and ends its session.
+func (c *testClient) Close() {
+	c.t.Helper()
+
+	c.Detach()
+
+	sessions.mu.Lock()
+	conn, has := sessions.m[c.nick]
+	sessions.mu.Unlock()
+	if has {
+		conn.stop()
+	}
+	waitFor(c.t, "session to end", func() bool {
+		sessions.mu.Lock()
+		defer sessions.mu.Unlock()
+
+		_, has := sessions.m[c.nick]
+		return !has
+	})
+}
+
+// Detach disconnects the client, leaving its session running, and waits for
+// BindSocket to return.
+func (c *testClient) Detach() {
+	c.t.Helper()
+
+	c.conn.Close()
+	select {
+	case err := <-c.done:
+		if err != nil {
+			c.t.Errorf("error from BindSocket: %s", err)
+		}
+	case <-time.After(testTimeout):
+		c.t.Errorf("timeout while waiting for the connection to close")
+	}
+}
+
+// waitFor waits until fn returns true, failing the test on timeout.
+func waitFor(t *testing.T, what string, fn func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout while waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
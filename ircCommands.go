@@ -6,15 +6,35 @@ import (
 	"log"
 	"strings"
 	"time"
+	"whapp-irc/capabilities"
+	"whapp-irc/config"
+	"whapp-irc/ircconnection"
+	"whapp-irc/types"
 	"whapp-irc/util"
+	"whapp-irc/whapp"
 
-	"gopkg.in/sorcix/irc.v2"
 	"gopkg.in/sorcix/irc.v2/ctcp"
 )
 
-func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message) error {
-	write := conn.irc.WriteNow
-	status := conn.irc.Status
+func init() {
+	capabilities.Server.Register("echo-message", "")
+}
+
+// handleIRCCommand handles the given message sent by the given client.
+func (conn *Connection) handleIRCCommand(
+	ctx context.Context,
+	client *ircconnection.Connection,
+	msg *ircconnection.Message,
+) error {
+	write := client.WriteNow
+	status := client.Status
+
+	// writeAll writes the given message to all attached clients.
+	writeAll := func(str string) error {
+		return eachClient(conn.clientList(), func(irc *ircconnection.Connection) error {
+			return irc.WriteNow(str)
+		})
+	}
 
 	switch msg.Command {
 	case "PRIVMSG":
@@ -25,10 +45,10 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 			body = fmt.Sprintf("_%s_", text)
 		}
 
-		util.LogMessage(time.Now(), conn.irc.Nick(), to, body)
+		util.LogMessage(time.Now(), client.Nick(), to, body)
 
 		if to == "status" {
-			return nil
+			return conn.handleStatusCommand(client, body)
 		}
 
 		item, has := conn.Chats.ByIdentifier(to, true)
@@ -36,15 +56,64 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 			return status("unknown chat")
 		}
 
-		if err := conn.WI.SendMessageToChatID(
-			ctx,
-			item.ID,
-			body,
-		); err != nil {
-			str := fmt.Sprintf("err while sending: %s", err)
+		quoted, stripped, err := conn.getReplyTarget(item, msg.Tags, body)
+		if err != nil {
+			return status(err.Error())
+		}
+
+		// echo the message as the client sent it, without the fallback reply
+		// syntax.
+		echo := msg.Params[1]
+		if stripped != body {
+			echo = stripped
+		}
+		body = stripped
+
+		// uploading a file can take a while, so that's done in the
+		// background to keep handling the commands of the client.
+		if quoted == nil && isUpload(body) {
+			go func() {
+				err := conn.sendMessage(ctx, client, msg, item, nil, body, echo)
+				util.LogIfErr("error while uploading file", err)
+			}()
+			return nil
+		}
+		return conn.sendMessage(ctx, client, msg, item, quoted, body, echo)
+
+	case "TAGMSG":
+		if len(msg.Params) == 0 {
+			return nil
+		}
+
+		reaction, err := conn.sendReaction(ctx, msg.Params[0], msg.Tags)
+		if err != nil {
+			str := fmt.Sprintf("err while sending reaction: %s", err)
 			log.Println(str)
 			return status(str)
+		} else if reaction != nil {
+			return conn.handleWhappReaction(conn.otherClients(client), *reaction)
+		}
+
+		if typing, has := msg.Tags["+typing"]; has {
+			err := conn.sendTyping(ctx, msg.Params[0], typing)
+			util.LogIfErr("error while sending typing state", err)
+		}
+
+		// relay the client-only tags to the other clients attached to this
+		// session.
+		tags := msg.Tags.ClientTags()
+		if len(tags) == 0 {
+			return nil
 		}
+		eachClient(conn.otherClients(client), func(irc *ircconnection.Connection) error {
+			return irc.TagMessage(time.Now(), tags, client.Nick(), msg.Params[0])
+		})
+
+	case "CHATHISTORY":
+		return conn.handleChatHistory(ctx, client, msg.Params)
+
+	case "MARKREAD":
+		return conn.handleMarkRead(client, msg.Params)
 
 	case "JOIN":
 		idents := strings.Split(msg.Params[0], ",")
@@ -54,7 +123,7 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 				return status("chat not found: " + msg.Params[0])
 			}
 
-			if err := conn.joinChat(item); err != nil {
+			if err := conn.joinChat(conn.clientList(), item); err != nil {
 				return status("error while joining: " + err.Error())
 			}
 		}
@@ -68,6 +137,9 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 			}
 
 			item.Chat.Joined = false
+
+			str := fmt.Sprintf(":%s PART %s", client.Nick(), item.Identifier)
+			writeAll(str)
 		}
 
 	case "MODE":
@@ -111,7 +183,7 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 				return status(str)
 			}
 
-			return write(fmt.Sprintf(":%s MODE %s +o %s", conn.irc.Nick(), ident, nick))
+			return writeAll(fmt.Sprintf(":%s MODE %s %s %s", client.Nick(), ident, mode, nick))
 		}
 
 	case "LIST":
@@ -124,14 +196,14 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 
 			str := fmt.Sprintf(
 				":whapp-irc 322 %s %s %d :%s",
-				conn.irc.Nick(),
+				client.Nick(),
 				item.Identifier,
 				nParticipants,
 				item.Chat.Name,
 			)
 			write(str)
 		}
-		write(fmt.Sprintf(":whapp-irc 323 %s :End of LIST", conn.irc.Nick()))
+		write(fmt.Sprintf(":whapp-irc 323 %s :End of LIST", client.Nick()))
 
 	case "WHO":
 		identifier := msg.Params[0]
@@ -152,7 +224,7 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 
 				msg := fmt.Sprintf(
 					":whapp-irc 352 %s %s %s whapp-irc whapp-irc %s %s :0 %s",
-					conn.irc.Nick(),
+					client.Nick(),
 					identifier,
 					p.SafeName(),
 					p.SafeName(),
@@ -164,19 +236,19 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 				}
 			}
 		}
-		write(fmt.Sprintf(":whapp-irc 315 %s %s :End of /WHO list.", conn.irc.Nick(), identifier))
+		write(fmt.Sprintf(":whapp-irc 315 %s %s :End of /WHO list.", client.Nick(), identifier))
 
 	case "WHOIS": // TODO: fix
 		item, _ := conn.Chats.ByIdentifier(msg.Params[0], false)
 		chat := item.Chat
 
 		if chat == nil || chat.IsGroupChat {
-			return write(fmt.Sprintf(":whapp-irc 401 %s %s :No such nick/channel", conn.irc.Nick(), msg.Params[0]))
+			return write(fmt.Sprintf(":whapp-irc 401 %s %s :No such nick/channel", client.Nick(), msg.Params[0]))
 		}
 
 		str := fmt.Sprintf(
 			":whapp-irc 311 %s %s ~%s whapp-irc * :%s",
-			conn.irc.Nick(),
+			client.Nick(),
 			item.Identifier,
 			item.Identifier,
 			chat.Name,
@@ -200,14 +272,14 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 
 			str := fmt.Sprintf(
 				":whapp-irc 319 %s %s :%s",
-				conn.irc.Nick(),
+				client.Nick(),
 				item.Identifier,
 				strings.Join(names, " "),
 			)
 			write(str)
 		}
 
-		write(fmt.Sprintf(":whapp-irc 318 %s %s :End of /WHOIS list.", conn.irc.Nick(), item.Identifier))
+		write(fmt.Sprintf(":whapp-irc 318 %s %s :End of /WHOIS list.", client.Nick(), item.Identifier))
 
 	case "KICK":
 		chatIdentifier := msg.Params[0]
@@ -217,7 +289,7 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 		if !has || !item.Chat.IsGroupChat {
 			str := fmt.Sprintf(
 				":whapp-irc 403 %s %s :No such channel",
-				conn.irc.Nick(),
+				client.Nick(),
 				chatIdentifier,
 			)
 			return write(str)
@@ -249,7 +321,7 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 		if !has || !item.Chat.IsGroupChat {
 			str := fmt.Sprintf(
 				":whapp-irc 442 %s %s :You're not on that channel",
-				conn.irc.Nick(),
+				client.Nick(),
 				chatIdentifier,
 			)
 			return write(str)
@@ -258,7 +330,7 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 		if !has || personChatInfo.Chat.IsGroupChat {
 			str := fmt.Sprintf(
 				":whapp-irc 401 %s %s :No such nick/channel",
-				conn.irc.Nick(),
+				client.Nick(),
 				nick,
 			)
 			return write(str)
@@ -277,3 +349,60 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 
 	return nil
 }
+
+// sendMessage sends the given body of the given PRIVMSG of client to the given
+// chat, quoting quoted if it's not nil, and reports the result to the attached
+// clients.
+func (conn *Connection) sendMessage(
+	ctx context.Context,
+	client *ircconnection.Connection,
+	msg *ircconnection.Message,
+	item types.ChatListItem,
+	quoted *whapp.Message,
+	body string,
+	echo string,
+) error {
+	to := msg.Params[0]
+
+	var id whapp.MessageID
+	var err error
+	if quoted != nil {
+		id, err = conn.WI.SendReplyToChatID(ctx, item.ID, body, quoted.ID)
+	} else {
+		id, err = conn.sendMessageOrUpload(ctx, item, body)
+	}
+	if err != nil {
+		str := fmt.Sprintf("err while sending: %s", err)
+		log.Println(str)
+
+		if client.Caps.Has("echo-message") {
+			// the client is waiting for the echo, tell it it won't come.
+			return client.WriteNow(fmt.Sprintf(
+				":whapp-irc FAIL PRIVMSG CANNOT_SEND %s :%s",
+				to,
+				str,
+			))
+		}
+		return client.Status(str)
+	}
+
+	// replying to a chat means we've read it, unless the client tells us so
+	// itself.
+	conn.markSeenByPolicy(
+		[]*ircconnection.Connection{client},
+		item,
+		config.MarkReadReply,
+	)
+
+	// echo the message to the other clients attached to this session, and to
+	// the sender if it wants it.
+	tags := msg.Tags.ClientTags()
+	tags["msgid"] = id.Serialized
+	eachClient(conn.clientList(), func(irc *ircconnection.Connection) error {
+		if irc == client && !irc.Caps.Has("echo-message") {
+			return nil
+		}
+		return irc.PrivateMessageTags(time.Now(), tags, client.Nick(), to, echo)
+	})
+	return nil
+}
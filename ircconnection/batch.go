@@ -0,0 +1,59 @@
+package ircconnection
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// A Batch groups the messages sent to a client, as specified by the IRCv3
+// batch extension. A nil Batch is valid and groups nothing, which is what
+// StartBatch returns for clients that don't support batches.
+type Batch struct {
+	conn *Connection
+	ref  string
+}
+
+// StartBatch starts a new batch of the given type and parameters, if the
+// client supports batches. Messages are added to the batch by sending them
+// with the tags returned by Tags, the batch must be closed using End.
+func (conn *Connection) StartBatch(typ string, params ...string) (*Batch, error) {
+	if !conn.Caps.Has("batch") {
+		return nil, nil
+	}
+
+	id := atomic.AddUint64(&conn.batchID, 1)
+	b := &Batch{
+		conn: conn,
+		ref:  strconv.FormatUint(id, 36),
+	}
+
+	str := strings.Join(append([]string{"BATCH", "+" + b.ref, typ}, params...), " ")
+	if err := conn.WriteNow(":whapp-irc " + str); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Tags returns the tags for a message in the current batch, merged with the
+// given tags.
+func (b *Batch) Tags(tags Tags) Tags {
+	if b == nil {
+		return tags
+	}
+
+	res := Tags{"batch": b.ref}
+	for key, value := range tags {
+		res[key] = value
+	}
+	return res
+}
+
+// End closes the current batch.
+func (b *Batch) End() error {
+	if b == nil {
+		return nil
+	}
+	return b.conn.WriteNow(fmt.Sprintf(":whapp-irc BATCH -%s", b.ref))
+}
@@ -0,0 +1,166 @@
+package ircconnection
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"whapp-irc/capabilities"
+)
+
+// maxCapLineLength is the maximum length of the capabilities in a single CAP
+// LS or LIST reply, longer lists are split up for clients supporting CAP
+// version 302.
+const maxCapLineLength = 400
+
+func init() {
+	capabilities.Server.Register("batch", "")
+	capabilities.Server.Register("cap-notify", "")
+	capabilities.Server.Register("message-tags", "")
+	capabilities.Server.Register("sasl", SASLPlain+","+SASLExternal)
+	capabilities.Server.Register("server-time", "")
+}
+
+// numericNick returns the nick to use in numeric and CAP replies.
+func (conn *Connection) numericNick() string {
+	if conn.nick == "" {
+		return "*"
+	}
+	return conn.nick
+}
+
+// hasCapNotify returns whether or not the client wants to be notified of
+// changes to the supported capabilities, which is implied by CAP version 302.
+func (conn *Connection) hasCapNotify() bool {
+	return conn.Caps.Has("cap-notify") || conn.Caps.Version() >= 302
+}
+
+// handleCap handles the given CAP message.
+func (conn *Connection) handleCap(msg *Message) error {
+	if len(msg.Params) == 0 {
+		return nil
+	}
+
+	conn.Caps.StartNegotiation()
+	nick := conn.numericNick()
+
+	switch strings.ToUpper(msg.Params[0]) {
+	case "LS":
+		if len(msg.Params) > 1 {
+			version, _ := strconv.Atoi(msg.Params[1])
+			conn.Caps.SetVersion(version)
+		}
+
+		withValues := conn.Caps.Version() >= 302
+		var caps []string
+		for _, c := range capabilities.Server.List() {
+			caps = append(caps, c.Format(withValues))
+		}
+		return conn.writeCapList(nick, "LS", caps)
+
+	case "LIST":
+		return conn.writeCapList(nick, "LIST", conn.Caps.List())
+
+	case "REQ":
+		if len(msg.Params) < 2 {
+			return nil
+		}
+		requested := msg.Trailing()
+		reqs := strings.Fields(requested)
+
+		// the request is only acknowledged if all requested changes can be
+		// made.
+		for _, req := range reqs {
+			name := strings.TrimPrefix(req, "-")
+			_, has := capabilities.Server.Get(name)
+			// cap-notify can't be disabled with CAP version 302
+			disableNotify := req == "-cap-notify" && conn.Caps.Version() >= 302
+
+			if !has || disableNotify {
+				return conn.WriteNow(fmt.Sprintf(":whapp-irc CAP %s NAK :%s", nick, requested))
+			}
+		}
+
+		for _, req := range reqs {
+			if strings.HasPrefix(req, "-") {
+				conn.Caps.Remove(req[1:])
+			} else {
+				conn.Caps.Add(req)
+			}
+		}
+		return conn.WriteNow(fmt.Sprintf(":whapp-irc CAP %s ACK :%s", nick, requested))
+
+	case "END":
+		conn.Caps.FinishNegotiation()
+	}
+
+	return nil
+}
+
+// writeCapList writes the given capabilities as a reply to the given CAP
+// subcommand, splitting them over multiple lines for clients supporting CAP
+// version 302.
+func (conn *Connection) writeCapList(nick, subcommand string, caps []string) error {
+	var lines []string
+	if conn.Caps.Version() < 302 {
+		lines = []string{strings.Join(caps, " ")}
+	} else {
+		line := ""
+		for _, c := range caps {
+			if line != "" && len(line)+1+len(c) > maxCapLineLength {
+				lines = append(lines, line)
+				line = ""
+			}
+
+			if line != "" {
+				line += " "
+			}
+			line += c
+		}
+		lines = append(lines, line)
+	}
+
+	for i, line := range lines {
+		more := ""
+		if i < len(lines)-1 {
+			more = "* "
+		}
+
+		str := fmt.Sprintf(":whapp-irc CAP %s %s %s:%s", nick, subcommand, more, line)
+		if err := conn.WriteNow(str); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// notifyCaps sends CAP NEW and DEL messages for changes to the supported
+// capabilities, if the client wants them, until ctx is done.
+func (conn *Connection) notifyCaps(ctx context.Context) {
+	changes := capabilities.Server.Subscribe(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case change := <-changes:
+			if change.Removed {
+				conn.Caps.Remove(change.Name)
+			}
+			if !conn.hasCapNotify() {
+				continue
+			}
+
+			var str string
+			if change.Removed {
+				str = fmt.Sprintf(":whapp-irc CAP %s DEL :%s", conn.numericNick(), change.Name)
+			} else {
+				withValues := conn.Caps.Version() >= 302
+				str = fmt.Sprintf(":whapp-irc CAP %s NEW :%s", conn.numericNick(), change.Format(withValues))
+			}
+			conn.WriteNow(str)
+		}
+	}
+}
@@ -1,12 +1,12 @@
 package ircconnection
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"strings"
 	"sync"
 	"time"
 	"whapp-irc/capabilities"
@@ -18,37 +18,55 @@ import (
 
 const queueSize = 10
 
+// TimeFormat is the format of timestamps in IRCv3 tags and commands.
+const TimeFormat = "2006-01-02T15:04:05.000Z"
+
 // Connection represents an IRC connection.
 type Connection struct {
+	// batchID is the last used batch reference, it's first to keep it
+	// aligned for atomic operations.
+	batchID uint64
+
 	Caps *capabilities.Map
 
-	receiveCh chan *irc.Message
+	receiveCh chan *Message
 	passCh    chan interface{}
 
 	ctx     context.Context
 	emitter *emitter.Emitter
 
-	nick string
-	pass string
+	nick    string
+	pass    string
+	account string
+
+	auth Authenticator
+	sasl *saslState
 
-	irc *irc.Conn
+	socket net.Conn
+	reader *bufio.Reader
+	irc    *irc.Conn
 }
 
 // HandleConnection wraps around the given socket connection, which you
 // shouldn't use after providing it.  It will then handle all the IRC connection
 // stuff for you.  You should interface with it using it's methods.
-func HandleConnection(ctx context.Context, socket *net.TCPConn) *Connection {
+// Credentials provided using SASL are checked using auth.
+func HandleConnection(ctx context.Context, socket net.Conn, auth Authenticator) *Connection {
 	ctx, cancel := context.WithCancel(ctx)
 	conn := &Connection{
 		Caps: capabilities.MakeMap(),
 
-		receiveCh: make(chan *irc.Message, queueSize),
+		receiveCh: make(chan *Message, queueSize),
 		passCh:    make(chan interface{}),
 
 		ctx:     ctx,
 		emitter: &emitter.Emitter{},
 
-		irc: irc.NewConn(socket),
+		auth: auth,
+
+		socket: socket,
+		reader: bufio.NewReader(socket),
+		irc:    irc.NewConn(socket),
 	}
 
 	// close irc connection when context ends
@@ -57,6 +75,8 @@ func HandleConnection(ctx context.Context, socket *net.TCPConn) *Connection {
 		conn.irc.Close()
 	}()
 
+	go conn.notifyCaps(ctx)
+
 	// listen for and parse messages.
 	// this function also handles IRC commands which are independent of the rest of
 	// whapp-irc, such as PINGs.
@@ -67,13 +87,16 @@ func HandleConnection(ctx context.Context, socket *net.TCPConn) *Connection {
 		var passOnce sync.Once
 
 		for {
-			msg, err := conn.irc.Decode()
+			line, err := conn.reader.ReadString('\n')
 			if err == io.EOF { // connection closed
 				return
 			} else if err != nil { // socket error
 				log.Printf("error while listening for IRC messages: %s\n", err)
 				return
-			} else if msg == nil { // invalid message
+			}
+
+			msg := parseMessage(line)
+			if msg == nil { // invalid message
 				log.Println("got invalid IRC message, ignoring")
 				continue
 			}
@@ -100,24 +123,19 @@ func HandleConnection(ctx context.Context, socket *net.TCPConn) *Connection {
 				passOnce.Do(func() { close(conn.passCh) })
 
 			case "CAP":
-				conn.Caps.StartNegotiation()
-				switch msg.Params[0] {
-				case "LS":
-					conn.WriteNow(":whapp-irc CAP * LS :server-time whapp-irc/replay")
-
-				case "LIST":
-					caps := conn.Caps.List()
-					conn.WriteNow(":whapp-irc CAP * LIST :" + strings.Join(caps, " "))
-
-				case "REQ":
-					for _, c := range strings.Split(msg.Trailing(), " ") {
-						conn.Caps.Add(c)
-					}
-					caps := conn.Caps.List()
-					conn.WriteNow(":whapp-irc CAP * ACK :" + strings.Join(caps, " "))
-
-				case "END":
-					conn.Caps.FinishNegotiation()
+				if err := conn.handleCap(msg); err != nil {
+					log.Printf("error while handling CAP: %s", err)
+					return
+				}
+
+			case "AUTHENTICATE":
+				if !conn.Caps.Has("sasl") || len(msg.Params) == 0 {
+					continue
+				}
+
+				if err := conn.handleAuthenticate(msg.Params[0]); err != nil {
+					log.Printf("error while handling AUTHENTICATE: %s", err)
+					return
 				}
 
 			default:
@@ -136,9 +154,26 @@ func write(w io.Writer, msg string) error {
 
 // Write writes the given message with the given timestamp to the connection
 func (conn *Connection) Write(time time.Time, msg string) error {
+	return conn.WriteTags(time, nil, msg)
+}
+
+// WriteTags writes the given message with the given timestamp and tags to the
+// connection. The tags are only sent if the client supports message-tags,
+// except for the batch tag which only requires batch.
+func (conn *Connection) WriteTags(time time.Time, tags Tags, msg string) error {
+	res := make(Tags)
+	if conn.Caps.Has("message-tags") {
+		for key, value := range tags {
+			res[key] = value
+		}
+	} else if ref, has := tags["batch"]; has && conn.Caps.Has("batch") {
+		res["batch"] = ref
+	}
 	if conn.Caps.Has("server-time") {
-		timeFormat := time.UTC().Format("2006-01-02T15:04:05.000Z")
-		msg = fmt.Sprintf("@time=%s %s", timeFormat, msg)
+		res["time"] = time.UTC().Format(TimeFormat)
+	}
+	if len(res) > 0 {
+		msg = fmt.Sprintf("@%s %s", res, msg)
 	}
 
 	if err := write(conn.irc, msg); err != nil {
@@ -168,9 +203,25 @@ func (conn *Connection) WriteListNow(messages []string) error {
 // PrivateMessage sends the given line as a private message from from, to to, on
 // the the given date.
 func (conn *Connection) PrivateMessage(date time.Time, from, to, line string) error {
+	return conn.PrivateMessageTags(date, nil, from, to, line)
+}
+
+// PrivateMessageTags is PrivateMessage, with the given tags.
+func (conn *Connection) PrivateMessageTags(date time.Time, tags Tags, from, to, line string) error {
 	util.LogMessage(date, from, to, line)
 	msg := formatPrivateMessage(from, to, line)
-	return conn.Write(date, msg)
+	return conn.WriteTags(date, tags, msg)
+}
+
+// TagMessage sends a TAGMSG with the given tags from from, to to, on the given
+// date. Nothing is sent if the client doesn't support message-tags.
+func (conn *Connection) TagMessage(date time.Time, tags Tags, from, to string) error {
+	if !conn.Caps.Has("message-tags") {
+		return nil
+	}
+
+	msg := fmt.Sprintf(":%s TAGMSG %s", from, to)
+	return conn.WriteTags(date, tags, msg)
 }
 
 // Status writes the given message as if sent by 'status' to the current
@@ -199,7 +250,7 @@ func (conn *Connection) Pass() string {
 }
 
 // ReceiveChannel returns the channel where new messages are sent on.
-func (conn *Connection) ReceiveChannel() <-chan *irc.Message {
+func (conn *Connection) ReceiveChannel() <-chan *Message {
 	return conn.receiveCh
 }
 
@@ -0,0 +1,157 @@
+package ircconnection
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// The SASL mechanisms supported.
+const (
+	SASLPlain    = "PLAIN"
+	SASLExternal = "EXTERNAL"
+)
+
+// maxSASLChunk is the maximum length of a single AUTHENTICATE payload, longer
+// payloads are split over multiple messages.
+const maxSASLChunk = 400
+
+// maxSASLPayload is the maximum total length of an AUTHENTICATE payload.
+const maxSASLPayload = 8192
+
+// Credentials contains the credentials provided by a client using SASL.
+type Credentials struct {
+	Mechanism string
+
+	// Account is the account the client wants to authenticate as. For
+	// EXTERNAL it defaults to the nickname of the client.
+	Account  string
+	Password string
+
+	// CertFingerprint is the fingerprint of the client certificate, if any.
+	CertFingerprint string
+}
+
+// An Authenticator returns whether or not the given credentials are valid.
+type Authenticator func(creds Credentials) bool
+
+// saslState contains the state of a running SASL authentication.
+type saslState struct {
+	mechanism string
+	buf       bytes.Buffer
+}
+
+// Account returns the account the user at the other end of the current
+// connection authenticated as using SASL, or an empty string if they didn't.
+func (conn *Connection) Account() string {
+	return conn.account
+}
+
+// saslMechanisms returns the SASL mechanisms available for the current
+// connection.
+func (conn *Connection) saslMechanisms() []string {
+	res := []string{SASLPlain}
+	if conn.CertFingerprint() != "" {
+		res = append(res, SASLExternal)
+	}
+	return res
+}
+
+// handleAuthenticate handles the given AUTHENTICATE parameter.
+func (conn *Connection) handleAuthenticate(param string) error {
+	nick := conn.numericNick()
+	fail := func() error {
+		conn.sasl = nil
+		return conn.WriteNow(fmt.Sprintf(":whapp-irc 904 %s :SASL authentication failed", nick))
+	}
+
+	switch {
+	case conn.account != "":
+		return conn.WriteNow(fmt.Sprintf(":whapp-irc 907 %s :You have already authenticated using SASL", nick))
+
+	case param == "*":
+		conn.sasl = nil
+		return conn.WriteNow(fmt.Sprintf(":whapp-irc 906 %s :SASL authentication aborted", nick))
+
+	case conn.sasl == nil:
+		mechanism := strings.ToUpper(param)
+
+		mechanisms := conn.saslMechanisms()
+		for _, m := range mechanisms {
+			if m == mechanism {
+				conn.sasl = &saslState{mechanism: mechanism}
+				return conn.WriteNow("AUTHENTICATE +")
+			}
+		}
+
+		str := fmt.Sprintf(
+			":whapp-irc 908 %s %s :are available SASL mechanisms",
+			nick,
+			strings.Join(mechanisms, ","),
+		)
+		if err := conn.WriteNow(str); err != nil {
+			return err
+		}
+		return fail()
+	}
+
+	// a payload, which is possibly split up in multiple chunks.
+	if param != "+" {
+		if len(param) > maxSASLChunk || conn.sasl.buf.Len()+len(param) > maxSASLPayload {
+			return fail()
+		}
+		conn.sasl.buf.WriteString(param)
+		if len(param) == maxSASLChunk {
+			return nil
+		}
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(conn.sasl.buf.String())
+	if err != nil {
+		return fail()
+	}
+
+	creds := Credentials{
+		Mechanism:       conn.sasl.mechanism,
+		CertFingerprint: conn.CertFingerprint(),
+	}
+	switch creds.Mechanism {
+	case SASLPlain:
+		// authzid \0 authcid \0 passwd
+		parts := strings.Split(string(payload), "\x00")
+		if len(parts) != 3 || (parts[0] != "" && parts[0] != parts[1]) {
+			return fail()
+		}
+		creds.Account = parts[1]
+		creds.Password = parts[2]
+
+	case SASLExternal:
+		creds.Account = string(payload)
+		if creds.Account == "" {
+			creds.Account = conn.nick
+		}
+	}
+
+	if creds.Account == "" || conn.auth == nil || !conn.auth(creds) {
+		return fail()
+	}
+
+	conn.sasl = nil
+	conn.account = creds.Account
+	if creds.Mechanism == SASLPlain {
+		conn.pass = creds.Password
+	}
+
+	return conn.WriteListNow([]string{
+		fmt.Sprintf(
+			":whapp-irc 900 %s %s!%s@whapp-irc %s :You are now logged in as %s",
+			nick,
+			nick,
+			nick,
+			conn.account,
+			conn.account,
+		),
+		fmt.Sprintf(":whapp-irc 903 %s :SASL authentication successful", nick),
+	})
+}
@@ -0,0 +1,135 @@
+package ircconnection
+
+import (
+	"sort"
+	"strings"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// Tags contains the IRCv3 tags of a message, tags without a value have an empty
+// string as value.
+type Tags map[string]string
+
+// A Message is an IRC message received from the client, with its tags.
+type Message struct {
+	*irc.Message
+	Tags Tags
+}
+
+var tagEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\:`,
+	" ", `\s`,
+	"\r", `\r`,
+	"\n", `\n`,
+)
+
+// unescapeTagValue unescapes the given escaped tag value, unknown escapes
+// result in the escaped character and a trailing backslash is dropped.
+func unescapeTagValue(value string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+
+		i++
+		if i == len(value) {
+			break
+		}
+		switch value[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+
+	return b.String()
+}
+
+// ParseTags parses the given raw tags, without the leading '@'.
+func ParseTags(raw string) Tags {
+	res := make(Tags)
+
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+
+		parts := strings.SplitN(tag, "=", 2)
+		value := ""
+		if len(parts) == 2 {
+			value = unescapeTagValue(parts[1])
+		}
+		res[parts[0]] = value
+	}
+
+	return res
+}
+
+// String formats the current tags, sorted by key and without the leading '@'.
+func (t Tags) String() string {
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for i, key := range keys {
+		if value := t[key]; value != "" {
+			keys[i] = key + "=" + tagEscaper.Replace(value)
+		}
+	}
+
+	return strings.Join(keys, ";")
+}
+
+// ClientTags returns the client-only tags, which are prefixed with '+', of the
+// current tags.
+func (t Tags) ClientTags() Tags {
+	res := make(Tags)
+	for key, value := range t {
+		if strings.HasPrefix(key, "+") {
+			res[key] = value
+		}
+	}
+	return res
+}
+
+// parseMessage parses the given raw line, including tags. It returns nil if
+// the line isn't a valid IRC message.
+func parseMessage(line string) *Message {
+	line = strings.TrimRight(line, "\r\n")
+
+	tags := make(Tags)
+	if strings.HasPrefix(line, "@") {
+		parts := strings.SplitN(line[1:], " ", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+
+		tags = ParseTags(parts[0])
+		line = strings.TrimLeft(parts[1], " ")
+	}
+
+	msg := irc.ParseMessage(line)
+	if msg == nil {
+		return nil
+	}
+
+	return &Message{
+		Message: msg,
+		Tags:    tags,
+	}
+}
@@ -0,0 +1,28 @@
+package ircconnection
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+)
+
+// CertFingerprint returns the hex encoded SHA-256 fingerprint of the client
+// certificate provided by the user at the other end of the current connection,
+// or an empty string if the connection isn't using TLS or no certificate has
+// been provided.
+// The TLS handshake is performed when the first message is read, so this
+// should be called after the client has sent something.
+func (conn *Connection) CertFingerprint() string {
+	tlsConn, ok := conn.socket.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(certs[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"net"
 	"time"
@@ -12,6 +13,10 @@ import (
 	"github.com/chromedp/chromedp"
 )
 
+// fileSweepInterval is the interval at which files are removed from the file
+// server according to the retention policy.
+const fileSweepInterval = 10 * time.Minute
+
 var (
 	conf config.Config
 
@@ -45,11 +50,20 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	fs.Authenticate = authenticateUpload
+	fs.MaxUploadSize = maxUploadSize
+	fs.Retention = files.Retention{
+		MaxAge:    conf.MediaMaxAge,
+		MaxSize:   conf.MediaMaxSize,
+		UserQuota: conf.MediaUserQuota,
+	}
+	fs.URLExpiry = conf.MediaURLExpiry
 	go func() {
 		if err := fs.Serve(); err != nil {
 			log.Fatalf("error while serving fileserver: %s", err)
 		}
 	}()
+	go fs.SweepEvery(fileSweepInterval)
 
 	pool, err = func() (*chromedp.Pool, error) {
 		switch conf.LogLevel {
@@ -64,20 +78,46 @@ func main() {
 	}
 	defer pool.Shutdown()
 
-	addr, err := net.ResolveTCPAddr("tcp", ":"+conf.IRCPort)
-	if err != nil {
-		panic(err)
+	var listeners []net.Listener
+
+	if conf.IRCPlaintext {
+		listener, err := net.Listen("tcp", ":"+conf.IRCPort)
+		if err != nil {
+			panic(err)
+		}
+		listeners = append(listeners, listener)
 	}
 
-	listener, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		panic(err)
+	if conf.IRCTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.IRCTLSCert, conf.IRCTLSKey)
+		if err != nil {
+			panic(err)
+		}
+
+		// client certificates are requested but not verified, they are used
+		// as an alternative to PASS by comparing their fingerprint.
+		listener, err := tls.Listen("tcp", ":"+conf.IRCTLSPort, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequestClientCert,
+		})
+		if err != nil {
+			panic(err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	for _, listener := range listeners[1:] {
+		go serve(listener)
 	}
+	serve(listeners[0])
+}
 
+// serve accepts IRC connections on the given listener.
+func serve(listener net.Listener) {
 	for {
-		socket, err := listener.AcceptTCP()
+		socket, err := listener.Accept()
 		if err != nil {
-			log.Printf("error accepting TCP connection: %s", err)
+			log.Printf("error accepting connection: %s", err)
 			continue
 		}
 
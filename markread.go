@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"whapp-irc/capabilities"
+	"whapp-irc/config"
+	"whapp-irc/ircconnection"
+	"whapp-irc/types"
+	"whapp-irc/whapp"
+)
+
+func init() {
+	capabilities.Server.Register("draft/read-marker", "")
+}
+
+// hasReadMarker returns whether or not the given client marks chats as read
+// itself, using MARKREAD.
+func hasReadMarker(irc *ircconnection.Connection) bool {
+	return irc.Caps.Has("draft/read-marker")
+}
+
+// readMarkers contains the time up to which the user read each chat, as set
+// using MARKREAD. They're only kept for the lifetime of the session.
+type readMarkers struct {
+	mu sync.Mutex
+	m  map[whapp.ID]time.Time
+}
+
+// Get returns the read marker of the chat with the given ID.
+func (r *readMarkers) Get(id whapp.ID) (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, has := r.m[id]
+	return t, has
+}
+
+// Set sets the read marker of the chat with the given ID to t, if it's after
+// the current marker. It returns whether or not the marker has been changed.
+func (r *readMarkers) Set(id whapp.ID, t time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.m == nil {
+		r.m = make(map[whapp.ID]time.Time)
+	}
+
+	if current, has := r.m[id]; has && !t.After(current) {
+		return false
+	}
+	r.m[id] = t
+	return true
+}
+
+// readMarkerLine returns the MARKREAD message with the read marker of the given
+// chat.
+func (conn *Connection) readMarkerLine(item types.ChatListItem) string {
+	timestamp := "*"
+	if t, has := conn.readMarkers.Get(item.ID); has {
+		timestamp = "timestamp=" + t.UTC().Format(ircconnection.TimeFormat)
+	}
+	return fmt.Sprintf(":whapp-irc MARKREAD %s %s", item.Identifier, timestamp)
+}
+
+// markSeen marks the given chat as read on WhatsApp, in the background.
+func (conn *Connection) markSeen(item types.ChatListItem) {
+	go func() {
+		if err := item.Chat.RawChat.SendSeen(conn.ctx, conn.WI); err != nil {
+			log.Printf("error while marking %s as read: %s", item.Identifier, err)
+		}
+	}()
+}
+
+// markSeenByPolicy marks the given chat as read on WhatsApp, if the configured
+// policy is the given one and none of the given clients marks chats as read
+// itself.
+func (conn *Connection) markSeenByPolicy(
+	clients []*ircconnection.Connection,
+	item types.ChatListItem,
+	policy config.MarkReadPolicy,
+) {
+	if conf.MarkRead != policy {
+		return
+	}
+	for _, irc := range clients {
+		if hasReadMarker(irc) {
+			return
+		}
+	}
+
+	conn.markSeen(item)
+}
+
+// handleMarkRead handles the MARKREAD command with the given parameters sent by
+// the given client.
+func (conn *Connection) handleMarkRead(client *ircconnection.Connection, params []string) error {
+	if len(params) == 0 {
+		return client.WriteNow(":whapp-irc FAIL MARKREAD NEED_MORE_PARAMS :Missing parameters")
+	}
+
+	item, has := conn.Chats.ByIdentifier(params[0], false)
+	if !has {
+		str := fmt.Sprintf(":whapp-irc FAIL MARKREAD INVALID_PARAMS %s :Unknown chat", params[0])
+		return client.WriteNow(str)
+	}
+
+	if len(params) == 1 {
+		return client.WriteNow(conn.readMarkerLine(item))
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(params[1], "timestamp="))
+	if err != nil || !strings.HasPrefix(params[1], "timestamp=") {
+		str := fmt.Sprintf(":whapp-irc FAIL MARKREAD INVALID_PARAMS %s :Invalid timestamp", item.Identifier)
+		return client.WriteNow(str)
+	}
+
+	if !conn.readMarkers.Set(item.ID, t) {
+		// the marker is older than the current one, tell the client about
+		// the current one.
+		return client.WriteNow(conn.readMarkerLine(item))
+	}
+
+	// WhatsApp can only mark a whole chat as read, so only do it when the
+	// user has read up to the last message.
+	last, found := conn.timestampMap.Get(item.ID)
+	if !found || !t.Before(time.Unix(last, 0)) {
+		conn.markSeen(item)
+	}
+
+	line := conn.readMarkerLine(item)
+	return eachClient(conn.clientList(), func(irc *ircconnection.Connection) error {
+		if !hasReadMarker(irc) {
+			return nil
+		}
+		return irc.WriteNow(line)
+	})
+}
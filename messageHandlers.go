@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strings"
 	"time"
+	"whapp-irc/ircconnection"
 	"whapp-irc/util"
 	"whapp-irc/whapp"
 )
@@ -23,9 +24,23 @@ func (msg *Message) Quoted() *whapp.Message {
 
 // MessageHandler represents a handler for a WhatsApp message to be sent to an
 // IRC client.
-type MessageHandler func(conn *Connection, msg Message) error
+type MessageHandler func(irc *ircconnection.Connection, msg Message) error
 
-var handlerNormal = func(conn *Connection, msg Message) error {
+var handlerNormal = func(irc *ircconnection.Connection, msg Message) error {
+	return writeMessage(irc, msg, nil)
+}
+
+// handlerBatch returns a MessageHandler which sends messages as part of the
+// given batch.
+func handlerBatch(batch *ircconnection.Batch) MessageHandler {
+	return func(irc *ircconnection.Connection, msg Message) error {
+		return writeMessage(irc, msg, batch.Tags(nil))
+	}
+}
+
+// writeMessage sends the given message to the given client, with its msgid and
+// the given extra tags.
+func writeMessage(irc *ircconnection.Connection, msg Message, extra ircconnection.Tags) error {
 	lines := strings.Split(msg.Body, "\n")
 	time := msg.Message.Time()
 
@@ -40,12 +55,23 @@ var handlerNormal = func(conn *Connection, msg Message) error {
 			)
 		}
 
-		return conn.irc.PrivateMessage(time, msg.From, msg.To, line)
+		return irc.PrivateMessageTags(time, extra, msg.From, msg.To, line)
 	}
 
-	for _, line := range lines {
-		if err := conn.irc.PrivateMessage(
+	for i, line := range lines {
+		tags := ircconnection.Tags{
+			"msgid": msgID(msg.Message, i),
+		}
+		for key, value := range extra {
+			tags[key] = value
+		}
+		if quoted := msg.Quoted(); quoted != nil && quoted.ID.Serialized != "" {
+			tags["+draft/reply"] = msgID(quoted, 0)
+		}
+
+		if err := irc.PrivateMessageTags(
 			time,
+			tags,
 			msg.From,
 			msg.To,
 			line,
@@ -57,7 +83,7 @@ var handlerNormal = func(conn *Connection, msg Message) error {
 	return nil
 }
 
-var handlerAlternativeReplay = func(conn *Connection, msg Message) error {
+var handlerAlternativeReplay = func(irc *ircconnection.Connection, msg Message) error {
 	if msg.IsReply {
 		return nil
 	}
@@ -73,10 +99,10 @@ var handlerAlternativeReplay = func(conn *Connection, msg Message) error {
 			line,
 		)
 
-		if err := conn.irc.PrivateMessage(
+		if err := irc.PrivateMessage(
 			time.Now(),
 			"replay",
-			conn.irc.Nick(),
+			irc.Nick(),
 			msg,
 		); err != nil {
 			return err
@@ -15,8 +15,15 @@ type MessageRes struct {
 type MessageQueue <-chan chan MessageRes
 
 // GetMessageQueue wraps around the given WhatsApp message channel and makes a
-// queue, queueing a maximum of queueSize items.
-func GetMessageQueue(ctx context.Context, ch <-chan whapp.Message, queueSize int) MessageQueue {
+// queue, queueing a maximum of queueSize items. Media is downloaded using the
+// given backend, and stored as owned by the given user.
+func GetMessageQueue(
+	ctx context.Context,
+	b whapp.Backend,
+	owner string,
+	ch <-chan whapp.Message,
+	queueSize int,
+) MessageQueue {
 	queue := make(chan chan MessageRes, queueSize)
 
 	go func() {
@@ -36,7 +43,7 @@ func GetMessageQueue(ctx context.Context, ch <-chan whapp.Message, queueSize int
 				queue <- ch
 
 				go func() {
-					err := downloadAndStoreMedia(msg)
+					err := downloadAndStoreMedia(ctx, b, owner, msg)
 					ch <- MessageRes{
 						Err:     err,
 						Message: msg,
@@ -0,0 +1,53 @@
+package messagemap
+
+import (
+	"sync"
+	"whapp-irc/whapp"
+)
+
+// A Map contains recent WhatsApp messages by their serialized ID. When it's
+// full, the oldest added messages are removed first.
+type Map struct {
+	mutex sync.RWMutex
+	size  int
+	ids   []string
+	m     map[string]whapp.Message
+}
+
+// New returns a new Map containing at most size messages.
+func New(size int) *Map {
+	return &Map{
+		size: size,
+		m:    make(map[string]whapp.Message),
+	}
+}
+
+// Add adds the given message to the map, replacing the message with the same
+// ID, if any.
+func (mm *Map) Add(msg whapp.Message) {
+	id := msg.ID.Serialized
+	if id == "" {
+		return
+	}
+
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	if _, has := mm.m[id]; !has {
+		if len(mm.ids) >= mm.size {
+			delete(mm.m, mm.ids[0])
+			mm.ids = mm.ids[1:]
+		}
+		mm.ids = append(mm.ids, id)
+	}
+	mm.m[id] = msg
+}
+
+// Get returns the message with the given serialized ID.
+func (mm *Map) Get(id string) (msg whapp.Message, found bool) {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+
+	msg, found = mm.m[id]
+	return msg, found
+}
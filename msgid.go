@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"whapp-irc/whapp"
+)
+
+// maxMessages is the maximum amount of WhatsApp messages kept per connection to
+// look up by their msgid.
+const maxMessages = 5000
+
+// msgID returns the IRCv3 msgid of the given line of the given WhatsApp
+// message. Since every line is sent as a separate PRIVMSG, lines after the
+// first get the line index as suffix to keep them unique.
+func msgID(msg *whapp.Message, line int) string {
+	id := msg.ID.Serialized
+	if line > 0 {
+		id += "/" + strconv.Itoa(line)
+	}
+	return id
+}
+
+// messageByMsgID returns the WhatsApp message with the given IRCv3 msgid, if
+// it's known.
+func (conn *Connection) messageByMsgID(msgid string) (whapp.Message, bool) {
+	if idx := strings.LastIndex(msgid, "/"); idx != -1 {
+		msgid = msgid[:idx]
+	}
+	return conn.messages.Get(msgid)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"whapp-irc/ircconnection"
+	"whapp-irc/whapp"
+
+	"gopkg.in/sorcix/irc.v2/ctcp"
+)
+
+// maxSnippetLength is the maximum length, in runes, of the snippet of a
+// message shown in reactions and receipts.
+const maxSnippetLength = 50
+
+// messageSnippet returns the first line of the given body, shortened to
+// maxSnippetLength runes.
+func messageSnippet(body string) string {
+	line := strings.SplitN(body, "\n", 2)[0]
+
+	runes := []rune(line)
+	if len(runes) > maxSnippetLength {
+		return string(runes[:maxSnippetLength]) + "…"
+	} else if len(runes) < len([]rune(body)) {
+		return line + "…"
+	}
+	return line
+}
+
+// deliverReaction sends the given WhatsApp reaction to the attached clients.
+// Unlike messages, reactions aren't kept while no client is attached.
+func (conn *Connection) deliverReaction(reaction whapp.Reaction) error {
+	conn.mu.Lock()
+	if reaction.SenderID == conn.me.SelfID &&
+		conn.sentReactions[reaction.MessageID] == reaction.Reaction {
+		// we sent this one ourselves, the clients already know about it.
+		delete(conn.sentReactions, reaction.MessageID)
+		conn.mu.Unlock()
+		return nil
+	}
+	clients := conn.clientListLocked()
+	conn.mu.Unlock()
+
+	if len(clients) == 0 {
+		return nil
+	}
+	return conn.handleWhappReaction(clients, reaction)
+}
+
+// handleWhappReaction sends the given WhatsApp reaction to the given clients, as
+// a TAGMSG with a +draft/react tag, or as an ACTION for clients without
+// message-tags.
+func (conn *Connection) handleWhappReaction(
+	clients []*ircconnection.Connection,
+	reaction whapp.Reaction,
+) error {
+	if reaction.Reaction == "" {
+		return nil // removing reactions isn't shown
+	}
+
+	msg, has := conn.messages.Get(reaction.MessageID)
+	if !has {
+		log.Printf("reaction to unknown message %s", reaction.MessageID)
+		return nil
+	}
+	item, has := conn.Chats.ByID(msg.Chat.ID, false)
+	if !has {
+		return nil
+	}
+	chat := item.Chat
+
+	fromMe := reaction.SenderID == conn.me.SelfID
+
+	var from string
+	switch {
+	case fromMe:
+		from = conn.nick
+	case chat.IsGroupChat:
+		from = reaction.SenderID.User
+		for _, p := range chat.Participants {
+			if p.ID == reaction.SenderID {
+				from = p.SafeName()
+				break
+			}
+		}
+	default:
+		from = item.Identifier
+	}
+
+	var to string
+	if chat.IsGroupChat || fromMe {
+		to = item.Identifier
+	} else {
+		to = conn.nick
+	}
+
+	date := time.Unix(reaction.Timestamp, 0)
+	tags := ircconnection.Tags{
+		"+draft/react": reaction.Reaction,
+		"+draft/reply": msgID(&msg, 0),
+	}
+	body := getMessageBody(msg, chat.Participants, conn.me)
+	action := ctcp.Action(fmt.Sprintf(
+		"reacted %s to: %s",
+		reaction.Reaction,
+		messageSnippet(body),
+	))
+
+	return eachClient(clients, func(irc *ircconnection.Connection) error {
+		if irc.Caps.Has("message-tags") {
+			return irc.TagMessage(date, tags, from, to)
+		}
+		return irc.PrivateMessage(date, from, to, action)
+	})
+}
+
+// sendReaction sends the reaction in the given tags of a TAGMSG to the chat
+// with the given identifier to WhatsApp, it returns nil if the tags don't
+// contain a reaction. A +draft/unreact tag removes the current reaction.
+func (conn *Connection) sendReaction(
+	ctx context.Context,
+	to string,
+	tags ircconnection.Tags,
+) (*whapp.Reaction, error) {
+	reaction, react := tags["+draft/react"]
+	if !react {
+		if _, unreact := tags["+draft/unreact"]; !unreact {
+			return nil, nil
+		}
+		reaction = ""
+	}
+
+	msgid, has := tags["+draft/reply"]
+	if !has {
+		return nil, fmt.Errorf("no message to react to given")
+	}
+	msg, found := conn.messageByMsgID(msgid)
+	if !found {
+		return nil, fmt.Errorf("message to react to not found")
+	}
+	if item, has := conn.Chats.ByIdentifier(to, true); !has || item.ID != msg.Chat.ID {
+		return nil, fmt.Errorf("message to react to is in another chat")
+	}
+
+	if err := conn.WI.SendReaction(ctx, msg.ID, reaction); err != nil {
+		return nil, err
+	}
+
+	conn.mu.Lock()
+	conn.sentReactions[msg.ID.Serialized] = reaction
+	conn.mu.Unlock()
+
+	return &whapp.Reaction{
+		MessageID: msg.ID.Serialized,
+		SenderID:  conn.me.SelfID,
+		Reaction:  reaction,
+		Timestamp: time.Now().Unix(),
+	}, nil
+}
@@ -2,18 +2,82 @@ package main
 
 import (
 	"context"
+	"whapp-irc/capabilities"
+	"whapp-irc/ircconnection"
 	"whapp-irc/whapp"
 )
 
-func (conn *Connection) hasReplay() bool {
-	return conn.irc.Caps.Has("whapp-irc/replay") || conf.AlternativeReplay
+func init() {
+	capabilities.Server.Register("whapp-irc/replay", "")
 }
 
-func (conn *Connection) handleWhappMessageReplay(ctx context.Context, msg whapp.Message) error {
+func hasReplay(irc *ircconnection.Connection) bool {
+	return irc.Caps.Has("whapp-irc/replay") || conf.AlternativeReplay
+}
+
+// handleWhappMessageReplay replays the given message to the given client, as
+// part of the given batch if it isn't nil.
+func (conn *Connection) handleWhappMessageReplay(
+	ctx context.Context,
+	irc *ircconnection.Connection,
+	batch *ircconnection.Batch,
+	msg whapp.Message,
+) error {
 	fn := handlerNormal
-	if conf.AlternativeReplay {
+	if batch != nil {
+		fn = handlerBatch(batch)
+	} else if conf.AlternativeReplay {
 		fn = handlerAlternativeReplay
 	}
 
-	return conn.handleWhappMessage(ctx, msg, fn)
+	clients := []*ircconnection.Connection{irc}
+	return conn.handleWhappMessage(ctx, clients, msg, fn)
+}
+
+// A replayBatcher replays messages to a client, wrapping consecutive messages
+// in the same chat in a chathistory batch if the client supports batches.
+type replayBatcher struct {
+	conn *Connection
+	irc  *ircconnection.Connection
+
+	chatID whapp.ID
+	batch  *ircconnection.Batch
+}
+
+// add replays the given message, starting a new batch if it's in another chat
+// than the previous message.
+func (r *replayBatcher) add(ctx context.Context, msg whapp.Message) error {
+	if r.batch == nil || msg.Chat.ID != r.chatID {
+		if err := r.end(); err != nil {
+			return err
+		}
+
+		// new chats don't have an identifier yet, their messages aren't
+		// batched.
+		if item, has := r.conn.Chats.ByID(msg.Chat.ID, false); has {
+			// the client has to be in the channel before the batch starts.
+			if item.Chat.IsGroupChat && !item.Chat.Joined {
+				clients := []*ircconnection.Connection{r.irc}
+				if err := r.conn.joinChat(clients, item); err != nil {
+					return err
+				}
+			}
+
+			batch, err := r.irc.StartBatch("chathistory", item.Identifier)
+			if err != nil {
+				return err
+			}
+			r.chatID = msg.Chat.ID
+			r.batch = batch
+		}
+	}
+
+	return r.conn.handleWhappMessageReplay(ctx, r.irc, r.batch, msg)
+}
+
+// end ends the current batch, if any.
+func (r *replayBatcher) end() error {
+	err := r.batch.End()
+	r.batch = nil
+	return err
 }
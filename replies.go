@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"whapp-irc/ircconnection"
+	"whapp-irc/types"
+	"whapp-irc/whapp"
+)
+
+// replyIndexRegex matches the fallback reply syntax for clients without
+// message-tags: "^N message" replies to the Nth most recent message in the
+// chat. A prefix like ">" is too common in normal messages.
+var replyIndexRegex = regexp.MustCompile(`^\^(\d{1,2}) (.+)$`)
+
+// recentMessage returns the nth (starting at 1) most recent message in the
+// given chat, ignoring notifications.
+func (conn *Connection) recentMessage(chat *types.Chat, n int) (whapp.Message, bool) {
+	conn.mu.Lock()
+	ids := append([]string(nil), chat.MessageIDs...)
+	conn.mu.Unlock()
+
+	for i := len(ids) - 1; i >= 0; i-- {
+		msg, has := conn.messages.Get(ids[i])
+		if !has || msg.IsNotification {
+			continue
+		}
+
+		n--
+		if n == 0 {
+			return msg, true
+		}
+	}
+
+	return whapp.Message{}, false
+}
+
+// getReplyTarget returns the message the PRIVMSG with the given tags and body
+// to the given chat replies to, or nil if it isn't a reply. The returned body
+// has the fallback reply syntax removed, it's left as is when there's no
+// message to reply to.
+func (conn *Connection) getReplyTarget(
+	item types.ChatListItem,
+	tags ircconnection.Tags,
+	body string,
+) (*whapp.Message, string, error) {
+	if msgid, has := tags["+draft/reply"]; has {
+		msg, found := conn.messageByMsgID(msgid)
+		if !found {
+			return nil, body, fmt.Errorf("message to reply to not found")
+		} else if msg.Chat.ID != item.ID {
+			return nil, body, fmt.Errorf("message to reply to is in another chat")
+		}
+		return &msg, body, nil
+	}
+
+	match := replyIndexRegex.FindStringSubmatch(body)
+	if match == nil || item.Chat == nil {
+		return nil, body, nil
+	}
+
+	n, _ := strconv.Atoi(match[1])
+	msg, found := conn.recentMessage(item.Chat, n)
+	if !found {
+		return nil, body, nil
+	}
+	return &msg, match[2], nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"whapp-irc/config"
+	"whapp-irc/database/lockmap"
+	"whapp-irc/ircconnection"
+	"whapp-irc/util"
+	"whapp-irc/whapp"
+)
+
+// maxDetachedMessages is the maximum amount of WhatsApp messages stored while
+// no IRC client is attached, older messages are dropped first.
+const maxDetachedMessages = 1000
+
+// sessions contains the running connections, by nickname.
+var sessions = struct {
+	mu    sync.Mutex
+	locks *lockmap.LockMap // held while setting up a connection
+	m     map[string]*Connection
+}{
+	locks: lockmap.New(),
+	m:     make(map[string]*Connection),
+}
+
+// getConnection returns the running connection for the nick of the given
+// client, or sets up a new one with irc attached to it. The WhatsApp session
+// of a new connection lives until it's logged out or fails, independent of
+// ctx, but if ctx is done during setup the setup is aborted.
+func getConnection(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	irc *ircconnection.Connection,
+) (conn *Connection, isNew bool, err error) {
+	nick := irc.Nick()
+
+	unlock := sessions.locks.Lock(nick)
+	defer unlock()
+
+	sessions.mu.Lock()
+	conn, has := sessions.m[nick]
+	sessions.mu.Unlock()
+	if has {
+		return conn, false, nil
+	}
+
+	sessionCtx, sessionCancel := context.WithCancel(context.Background())
+
+	// abort the setup when the client goes away
+	setupDone := make(chan struct{})
+	defer close(setupDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sessionCancel()
+		case <-setupDone:
+		}
+	}()
+
+	conn, err = setupConnection(sessionCtx, irc, cancel)
+	if err != nil {
+		sessionCancel()
+		return nil, false, err
+	}
+	conn.ctx = sessionCtx
+	conn.stop = sessionCancel
+
+	sessions.mu.Lock()
+	sessions.m[nick] = conn
+	sessions.mu.Unlock()
+
+	// when the session ends, remove it and disconnect the attached clients.
+	go func() {
+		<-sessionCtx.Done()
+
+		sessions.mu.Lock()
+		if sessions.m[nick] == conn {
+			delete(sessions.m, nick)
+		}
+		sessions.mu.Unlock()
+
+		conn.mu.Lock()
+		for _, cancel := range conn.clients {
+			cancel()
+		}
+		conn.mu.Unlock()
+
+		log.Printf("session of %s ended", nick)
+	}()
+
+	return conn, true, nil
+}
+
+// attach attaches the given IRC client to the current connection, sending it
+// the joined chats and replaying the messages received while no client was
+// attached.
+func (conn *Connection) attach(ctx context.Context, irc *ircconnection.Connection, cancel context.CancelFunc) {
+	conn.deliverMu.Lock()
+	defer conn.deliverMu.Unlock()
+
+	conn.mu.Lock()
+	conn.clients[irc] = cancel
+	messages := conn.detachedMessages
+	conn.detachedMessages = nil
+	conn.mu.Unlock()
+
+	for _, item := range conn.Chats.List(false) {
+		if !item.Chat.Joined {
+			continue
+		}
+
+		err := conn.writeJoin(irc, item)
+		util.LogIfErr("error while rejoining chat", err)
+	}
+
+	if n := len(messages); n > 0 {
+		irc.Status(fmt.Sprintf(
+			"replaying %d %s received while detached",
+			n,
+			util.Plural(n, "message", "messages"),
+		))
+	}
+	replayer := &replayBatcher{conn: conn, irc: irc}
+	for _, msg := range messages {
+		err := replayer.add(ctx, msg)
+		util.LogIfErr("error handling whapp message received while detached", err)
+	}
+	util.LogIfErr("error ending replay batch", replayer.end())
+}
+
+// detach detaches the given IRC client from the current connection, if it's
+// attached.
+func (conn *Connection) detach(irc *ircconnection.Connection) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	delete(conn.clients, irc)
+}
+
+// clientList returns the IRC clients currently attached to the connection.
+func (conn *Connection) clientList() []*ircconnection.Connection {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	return conn.clientListLocked()
+}
+
+// clientListLocked is clientList, for when conn.mu is already held.
+func (conn *Connection) clientListLocked() []*ircconnection.Connection {
+	res := make([]*ircconnection.Connection, 0, len(conn.clients))
+	for irc := range conn.clients {
+		res = append(res, irc)
+	}
+	return res
+}
+
+// otherClients returns the IRC clients attached to the connection, except for
+// the given one.
+func (conn *Connection) otherClients(irc *ircconnection.Connection) []*ircconnection.Connection {
+	var res []*ircconnection.Connection
+	for _, other := range conn.clientList() {
+		if other != irc {
+			res = append(res, other)
+		}
+	}
+	return res
+}
+
+// eachClient calls fn for every client in clients, an error for one client
+// doesn't stop the others. The first error is returned.
+func eachClient(
+	clients []*ircconnection.Connection,
+	fn func(irc *ircconnection.Connection) error,
+) error {
+	var res error
+	for _, irc := range clients {
+		if err := fn(irc); err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+// deliver handles the given WhatsApp message for all attached clients, or
+// stores it until one attaches.
+func (conn *Connection) deliver(ctx context.Context, msg whapp.Message) error {
+	conn.deliverMu.Lock()
+	defer conn.deliverMu.Unlock()
+
+	conn.mu.Lock()
+	if len(conn.clients) == 0 {
+		if len(conn.detachedMessages) >= maxDetachedMessages {
+			conn.detachedMessages = conn.detachedMessages[1:]
+		}
+		conn.detachedMessages = append(conn.detachedMessages, msg)
+		conn.mu.Unlock()
+		return nil
+	}
+	clients := conn.clientListLocked()
+	conn.mu.Unlock()
+
+	if err := conn.handleWhappMessage(ctx, clients, msg, handlerNormal); err != nil {
+		return err
+	}
+
+	if item, has := conn.Chats.ByID(msg.Chat.ID, false); has && !msg.IsSentByMe && !msg.IsNotification {
+		conn.markSeenByPolicy(clients, item, config.MarkReadDeliver)
+	}
+	return nil
+}
+
+// status sends the given status message to the attached clients.
+func (conn *Connection) status(body string) {
+	log.Printf("status for %s: %s", conn.nick, body)
+	eachClient(conn.clientList(), func(irc *ircconnection.Connection) error {
+		return irc.Status(body)
+	})
+}
+
+// consume handles the events of a WhatsApp listener until ctx is done or the
+// listener sends an error on errCh, which is logged and returned. handle
+// should wait for and handle a single event, or return when its ctx is done.
+// Errors returned by handle are logged, what describes the events in the logs.
+func consume(
+	ctx context.Context,
+	what string,
+	errCh <-chan error,
+	handle func(ctx context.Context) error,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	res := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			res <- nil
+		case err := <-errCh:
+			util.LogIfErr("error while listening for whatsapp "+what, err)
+			res <- err
+			cancel()
+		}
+	}()
+
+	for ctx.Err() == nil {
+		util.LogIfErr("error handling whapp "+what, handle(ctx))
+	}
+
+	cancel()
+	return <-res
+}
+
+// start starts listening for WhatsApp messages and login state changes, until
+// the session ends.
+func (conn *Connection) start() {
+	ctx, cancel := conn.ctx, conn.stop
+
+	// handle logging out on whatsapp web, this happens when the user removes
+	// the bridge client on their phone.
+	go func() {
+		defer cancel()
+
+		resCh, errCh := conn.WI.ListenLoggedIn(ctx, 3*time.Second)
+		consume(ctx, "loggedin state", errCh, func(ctx context.Context) error {
+			select {
+			case <-ctx.Done():
+			case res := <-resCh:
+				if !res {
+					conn.status("logged out of whatsapp")
+					cancel()
+				}
+			}
+			return nil
+		})
+	}()
+
+	// listen for new WhatsApp messages
+	go func() {
+		defer cancel()
+
+		messageCh, errCh := conn.WI.ListenForMessages(
+			ctx,
+			500*time.Millisecond,
+		)
+		queue := GetMessageQueue(ctx, conn.WI, conn.nick, messageCh, 50)
+
+		err := consume(ctx, "messages", errCh, func(ctx context.Context) error {
+			select {
+			case <-ctx.Done():
+				return nil
+			case msgRes := <-<-queue:
+				if msgRes.Err != nil {
+					return msgRes.Err
+				}
+				return conn.deliver(ctx, msgRes.Message)
+			}
+		})
+		if err == whapp.ErrLoggedOut {
+			conn.status("logged out of whatsapp")
+		} else if err != nil {
+			// the backend already tried to recover, so there's nothing left
+			// for us to do.
+			conn.status("lost connection to WhatsApp Web: " + err.Error())
+		}
+	}()
+
+	// listen for acks, reactions and chat states, not being able to do so
+	// isn't fatal for the session.
+	go func() {
+		ackCh, errCh := conn.WI.ListenForAcks(ctx)
+		consume(ctx, "acks", errCh, func(ctx context.Context) error {
+			select {
+			case <-ctx.Done():
+				return nil
+			case ack := <-ackCh:
+				return conn.deliverAck(ack)
+			}
+		})
+	}()
+	go func() {
+		reactionCh, errCh := conn.WI.ListenForReactions(ctx)
+		consume(ctx, "reactions", errCh, func(ctx context.Context) error {
+			select {
+			case <-ctx.Done():
+				return nil
+			case reaction := <-reactionCh:
+				return conn.deliverReaction(reaction)
+			}
+		})
+	}()
+	go func() {
+		stateCh, errCh := conn.WI.ListenForChatStates(ctx)
+		consume(ctx, "chat states", errCh, func(ctx context.Context) error {
+			select {
+			case <-ctx.Done():
+				return nil
+			case state := <-stateCh:
+				return conn.handleWhappChatState(conn.clientList(), state)
+			}
+		})
+	}()
+}
@@ -8,7 +8,9 @@ import (
 	"sync"
 	"time"
 	"whapp-irc/bridge"
+	"whapp-irc/files"
 	"whapp-irc/ircconnection"
+	"whapp-irc/messagemap"
 	"whapp-irc/timestampmap"
 	"whapp-irc/types"
 	"whapp-irc/util"
@@ -17,32 +19,75 @@ import (
 	qrcode "github.com/skip2/go-qrcode"
 )
 
-func setupConnection(ctx context.Context, irc *ircconnection.Connection) (*Connection, error) {
-	wi, err := bridge.Start(ctx, pool, conf.LogLevel)
+// startBackend starts a new WhatsApp backend for the given connection. It's a
+// variable so it can be swapped out for a fake in tests.
+var startBackend = func(ctx context.Context, conn *Connection) (whapp.Backend, error) {
+	return bridge.Start(ctx, pool, conf.LogLevel, bridge.Hooks{
+		Status: conn.status,
+		LocalStorage: func() (map[string]string, error) {
+			var user types.User
+			_, err := userDb.GetItem(conn.nick, &user)
+			return user.LocalStorage, err
+		},
+	})
+}
+
+func setupConnection(
+	ctx context.Context,
+	irc *ircconnection.Connection,
+	cancel context.CancelFunc,
+) (*Connection, error) {
+	passwordHash, err := types.HashPassword(irc.Pass())
 	if err != nil {
 		return nil, err
 	}
 
 	conn := &Connection{
-		WI:    wi,
 		Chats: &types.ChatList{},
 
-		irc: irc,
+		nick:            irc.Nick(),
+		passwordHash:    passwordHash,
+		certFingerprint: irc.CertFingerprint(),
+
+		clients: map[*ircconnection.Connection]context.CancelFunc{
+			irc: cancel,
+		},
+		sentReactions: make(map[string]string),
 
 		timestampMap: timestampmap.New(),
+		messages:     messagemap.New(maxMessages),
 	}
 
+	wi, err := startBackend(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.WI = wi
+
 	// if we have the current user in the database, try to relogin using the
 	// previous localStorage state
 	var user types.User
-	found, err := userDb.GetItem(conn.irc.Nick(), &user)
+	found, err := userDb.GetItem(conn.nick, &user)
 	if err != nil {
 		return nil, err
 	} else if found {
+		// keep the stored credentials, the client might have authenticated
+		// using only one of them.
+		if user.Password != "" {
+			conn.passwordHash, err = user.HashedPassword()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if user.CertFingerprint != "" {
+			conn.certFingerprint = user.CertFingerprint
+		}
+		conn.uploadToken = user.UploadToken
+
 		conn.timestampMap.Swap(user.LastReceivedReceipts)
 		conn.Chats = types.ChatListFromSlice(user.Chats)
 
-		conn.irc.Status("logging in using stored session")
+		conn.status("logging in using stored session")
 
 		if err := wi.Navigate(ctx); err != nil {
 			return nil, err
@@ -55,6 +100,12 @@ func setupConnection(ctx context.Context, irc *ircconnection.Connection) (*Conne
 		}
 	}
 
+	if conn.uploadToken == "" {
+		if conn.uploadToken, err = newUploadToken(); err != nil {
+			return nil, err
+		}
+	}
+
 	// open site
 	state, err := wi.Open(ctx)
 	if err != nil {
@@ -74,7 +125,10 @@ func setupConnection(ctx context.Context, irc *ircconnection.Connection) (*Conne
 		}
 
 		timestamp := strconv.FormatInt(time.Now().UnixNano(), 10)
-		qrFile, err := fs.AddBlob("qr-"+timestamp, "png", bytes)
+		qrFile, err := fs.AddBlob("qr-"+timestamp, "png", bytes, files.Metadata{
+			Owner:    conn.nick,
+			MimeType: "image/png",
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -83,16 +137,14 @@ func setupConnection(ctx context.Context, irc *ircconnection.Connection) (*Conne
 			util.LogIfErr("error while removing QR code", err)
 		}()
 
-		if err := conn.irc.Status("Scan this QR code: " + qrFile.URL); err != nil {
-			return nil, err
-		}
+		conn.status("Scan this QR code: " + fs.URL(qrFile))
 	}
 
 	// waiting for login
 	if err := wi.WaitLogin(ctx); err != nil {
 		return nil, err
 	}
-	conn.irc.Status("logged in")
+	conn.status("logged in")
 
 	// get localstorage (that contains new login information), and save it to
 	// the database
@@ -129,7 +181,7 @@ func setupConnection(ctx context.Context, irc *ircconnection.Connection) (*Conne
 			participants, err := raw.Participants(ctx, conn.WI)
 			if err != nil {
 				str := fmt.Sprintf("error while fetching participants for chat with ID %s, skipping", raw.ID)
-				conn.irc.Status(str)
+				conn.status(str)
 				log.Printf("%s. error: %s", str, err)
 				return
 			}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"whapp-irc/ircconnection"
+	"whapp-irc/types"
+)
+
+// handleStatusCommand handles the given message sent by the given client to
+// the status user, which is used to change settings.
+func (conn *Connection) handleStatusCommand(client *ircconnection.Connection, body string) error {
+	status := client.Status
+
+	fields := strings.Fields(body)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "receipts":
+		if len(fields) < 2 || len(fields) > 3 {
+			return status("usage: receipts <chat> [tags|notices|off]")
+		}
+
+		item, has := conn.Chats.ByIdentifier(fields[1], false)
+		if !has {
+			return status("unknown chat")
+		}
+		settings := item.Settings
+
+		if len(fields) == 2 {
+			return status(fmt.Sprintf(
+				"receipts for %s: %s",
+				item.Identifier,
+				settings.EffectiveReceipts(),
+			))
+		}
+
+		mode := types.ReceiptsMode(strings.ToLower(fields[2]))
+		switch mode {
+		case types.ReceiptsTags, types.ReceiptsNotices, types.ReceiptsOff:
+		default:
+			return status("unknown receipts mode " + fields[2])
+		}
+
+		settings.Receipts = mode
+		conn.Chats.SetSettings(item.ID, settings)
+		if err := conn.saveDatabaseEntry(); err != nil {
+			return status("error while saving settings: " + err.Error())
+		}
+		return status(fmt.Sprintf("receipts for %s set to %s", item.Identifier, mode))
+
+	case "upload-token":
+		if len(fields) == 2 && strings.ToLower(fields[1]) == "reset" {
+			token, err := newUploadToken()
+			if err != nil {
+				return status("error while generating upload token: " + err.Error())
+			}
+
+			conn.mu.Lock()
+			conn.uploadToken = token
+			conn.mu.Unlock()
+			if err := conn.saveDatabaseEntry(); err != nil {
+				return status("error while saving upload token: " + err.Error())
+			}
+		} else if len(fields) != 1 {
+			return status("usage: upload-token [reset]")
+		}
+
+		conn.mu.Lock()
+		token := conn.uploadToken
+		conn.mu.Unlock()
+		return status(fmt.Sprintf(
+			"upload files to %s using HTTP basic auth with your nick and upload token %s",
+			fs.UploadURL(),
+			token,
+		))
+
+	default:
+		return status("unknown command " + fields[0])
+	}
+}
@@ -25,8 +25,9 @@ func getIdentifierPrefix(identifier string) string {
 // ChatListItem is the struct stored in a connection per chat item. It is also
 // used to persist the Identifier<->ID mapping on disk.
 type ChatListItem struct {
-	Identifier string   `json:"identifier"`
-	ID         whapp.ID `json:"id"`
+	Identifier string       `json:"identifier"`
+	ID         whapp.ID     `json:"id"`
+	Settings   ChatSettings `json:"settings"`
 
 	Chat *Chat `json:"-"`
 }
@@ -120,6 +121,21 @@ func (l *ChatList) ByID(id whapp.ID, allowNil bool) (item ChatListItem, found bo
 	return ChatListItem{}, false
 }
 
+// SetSettings changes the settings of the chat with the given ID, it returns
+// false if the chat isn't in the current list.
+func (l *ChatList) SetSettings(id whapp.ID, settings ChatSettings) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, item := range l.chats {
+		if item.ID == id {
+			l.chats[i].Settings = settings
+			return true
+		}
+	}
+	return false
+}
+
 // ByIdentifier returns the chat with the given identifier, if any.
 func (l *ChatList) ByIdentifier(identifier string, allowNil bool) (item ChatListItem, found bool) {
 	identifier = strings.ToLower(identifier)
@@ -0,0 +1,53 @@
+package types
+
+import (
+	"crypto/subtle"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashPassword returns the hash of the given password to store in the
+// database. An empty password results in an empty hash.
+func HashPassword(pass string) (string, error) {
+	if pass == "" {
+		return "", nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// isHashed returns whether the given stored password is hashed, older versions
+// of whapp-irc stored passwords in plain text.
+func isHashed(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return err == nil
+}
+
+// HasCredentials returns whether or not the current User has a password or
+// client certificate fingerprint set.
+func (u User) HasCredentials() bool {
+	return u.Password != "" || u.CertFingerprint != ""
+}
+
+// CheckPassword returns whether or not the given password matches the
+// password of the current User.
+func (u User) CheckPassword(pass string) bool {
+	if u.Password == "" {
+		return false
+	} else if !isHashed(u.Password) {
+		return subtle.ConstantTimeCompare([]byte(u.Password), []byte(pass)) == 1
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(pass))
+	return err == nil
+}
+
+// HashedPassword returns the hashed password of the current User, hashing it
+// if it's stored in plain text.
+func (u User) HashedPassword() (string, error) {
+	if u.Password == "" || isHashed(u.Password) {
+		return u.Password, nil
+	}
+	return HashPassword(u.Password)
+}
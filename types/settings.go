@@ -0,0 +1,31 @@
+package types
+
+// ReceiptsMode is the way changes in the acknowledgement state of messages sent
+// by the user are shown.
+type ReceiptsMode string
+
+// The available receipts modes.
+const (
+	// ReceiptsTags sends a TAGMSG to clients supporting message-tags, this is
+	// the default.
+	ReceiptsTags ReceiptsMode = "tags"
+	// ReceiptsNotices sends a notice to all clients.
+	ReceiptsNotices ReceiptsMode = "notices"
+	// ReceiptsOff doesn't show receipts at all.
+	ReceiptsOff ReceiptsMode = "off"
+)
+
+// ChatSettings are the per chat settings of an user, changed by sending
+// commands to the status user.
+type ChatSettings struct {
+	Receipts ReceiptsMode `json:"receipts,omitempty"`
+}
+
+// EffectiveReceipts returns the receipts mode of the current settings, which
+// is ReceiptsTags if it isn't set.
+func (s ChatSettings) EffectiveReceipts() ReceiptsMode {
+	if s.Receipts == "" {
+		return ReceiptsTags
+	}
+	return s.Receipts
+}
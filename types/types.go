@@ -92,6 +92,8 @@ func (c *Chat) HasMessageID(id string) bool {
 // User represents the on-disk format of an user of the bridge.
 type User struct {
 	Password             string            `json:"password"`
+	CertFingerprint      string            `json:"certFingerprint,omitempty"`
+	UploadToken          string            `json:"uploadToken,omitempty"`
 	LocalStorage         map[string]string `json:"localStorage"`
 	LastReceivedReceipts map[string]int64  `json:"lastReceivedReceipts"`
 	Chats                []ChatListItem    `json:"chats"`
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"whapp-irc/ircconnection"
+	"whapp-irc/whapp"
+)
+
+// typingStates maps WhatsApp chat states to the values of the +typing tag.
+var typingStates = map[string]string{
+	whapp.ChatStateComposing: "active",
+	whapp.ChatStateRecording: "active",
+	whapp.ChatStatePaused:    "paused",
+	whapp.ChatStateAvailable: "done",
+}
+
+// chatStates maps the values of the +typing tag to WhatsApp chat states.
+var chatStates = map[string]string{
+	"active": whapp.ChatStateComposing,
+	"paused": whapp.ChatStatePaused,
+	"done":   whapp.ChatStateAvailable,
+}
+
+// handleWhappChatState sends the given WhatsApp chat state to the given clients
+// supporting message-tags, as a TAGMSG with a +typing tag.
+func (conn *Connection) handleWhappChatState(
+	clients []*ircconnection.Connection,
+	state whapp.ChatState,
+) error {
+	if state.SenderID == conn.me.SelfID {
+		return nil
+	}
+
+	typing, has := typingStates[state.State]
+	if !has {
+		return nil
+	}
+
+	item, has := conn.Chats.ByID(state.ChatID, false)
+	if !has {
+		return nil
+	}
+	chat := item.Chat
+
+	from, to := item.Identifier, conn.nick
+	if chat.IsGroupChat {
+		from, to = state.SenderID.User, item.Identifier
+		for _, p := range chat.Participants {
+			if p.ID == state.SenderID {
+				from = p.SafeName()
+				break
+			}
+		}
+	}
+
+	tags := ircconnection.Tags{"+typing": typing}
+	return eachClient(clients, func(irc *ircconnection.Connection) error {
+		if !irc.Caps.Has("message-tags") {
+			return nil
+		}
+		return irc.TagMessage(time.Now(), tags, from, to)
+	})
+}
+
+// sendTyping sets our chat state in the chat with the given identifier to the
+// given value of a +typing tag.
+func (conn *Connection) sendTyping(ctx context.Context, identifier, typing string) error {
+	state, has := chatStates[typing]
+	if !has {
+		return fmt.Errorf("unknown typing state %s", typing)
+	}
+
+	item, has := conn.Chats.ByIdentifier(identifier, false)
+	if !has {
+		return fmt.Errorf("unknown chat %s", identifier)
+	}
+
+	return item.Chat.RawChat.SendChatState(ctx, conn.WI, state)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"whapp-irc/types"
+	"whapp-irc/util"
+	"whapp-irc/whapp"
+)
+
+// maxUploadSize is the maximum size, in bytes, of a file uploaded from IRC.
+// WhatsApp doesn't accept larger documents, and has a lower limit for other
+// media.
+const maxUploadSize = whapp.MaxDocumentSize
+
+// uploadClient is the HTTP client used to fetch the files uploaded from IRC.
+// Redirects are only followed to allowed hosts, and private addresses are only
+// connected to if their host is explicitly allowed.
+var uploadClient = &http.Client{
+	Timeout: time.Minute,
+	Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialUpload,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		} else if !uploadHostAllowed(req.URL.Hostname()) {
+			return fmt.Errorf("redirect to disallowed host %s", req.URL.Hostname())
+		}
+		return nil
+	},
+}
+
+// errNotAFile is returned by fetchUpload when the URL points to a web page,
+// which should be sent as a link instead.
+var errNotAFile = errors.New("not a file")
+
+// isFileServerURL returns whether or not the given URL is on our own file
+// server. Its files are read from disk, it's never connected to.
+func isFileServerURL(u *url.URL) bool {
+	port := u.Port()
+	if port == "" && u.Scheme == "https" {
+		port = "443"
+	} else if port == "" {
+		port = "80"
+	}
+	return strings.EqualFold(u.Hostname(), fs.Host) && port == fs.Port
+}
+
+// uploadHostAllowed returns whether or not files on the given host may be
+// fetched and uploaded to WhatsApp.
+func uploadHostAllowed(host string) bool {
+	if uploadHostListed(host) {
+		return true
+	}
+	for _, h := range conf.UploadHosts {
+		if h == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadHostListed returns whether or not the given host is explicitly listed
+// in UPLOAD_HOSTS.
+func uploadHostListed(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range conf.UploadHosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// privateNetworks are the networks of private, loopback and link-local
+// addresses.
+var privateNetworks = func() []*net.IPNet {
+	var res []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		res = append(res, network)
+	}
+	return res
+}()
+
+// isPrivateIP returns whether or not the given IP is a private, loopback or
+// link-local address.
+func isPrivateIP(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialUpload connects to the given address for uploadClient, refusing private
+// addresses unless the host is explicitly listed in UPLOAD_HOSTS.
+func dialUpload(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	} else if uploadHostListed(host) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip.IP) {
+			return nil, fmt.Errorf("refusing to connect to private address %s of %s", ip.IP, host)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+
+	// connect to the checked address, instead of resolving the host again.
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].IP.String(), port))
+}
+
+// parseUpload returns the URL the given message body starts with and the rest
+// of the body as caption, if the URL is on our own file server or an allowed
+// host. Otherwise u is nil.
+func parseUpload(body string) (u *url.URL, caption string) {
+	fields := strings.SplitN(strings.TrimSpace(body), " ", 2)
+
+	u, err := url.Parse(fields[0])
+	if err != nil ||
+		(u.Scheme != "http" && u.Scheme != "https") ||
+		(!isFileServerURL(u) && !uploadHostAllowed(u.Hostname())) {
+		return nil, ""
+	}
+
+	if len(fields) == 2 {
+		caption = strings.TrimSpace(fields[1])
+	}
+	return u, caption
+}
+
+// fetchUpload downloads the file at the given URL.
+func fetchUpload(ctx context.Context, u *url.URL) (whapp.MediaFile, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return whapp.MediaFile{}, err
+	}
+
+	res, err := uploadClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return whapp.MediaFile{}, err
+	}
+	defer res.Body.Close()
+
+	headerType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if res.StatusCode != http.StatusOK {
+		return whapp.MediaFile{}, fmt.Errorf("unexpected status %s", res.Status)
+	} else if max := whapp.MaxFileSize(headerType); res.ContentLength > max {
+		return whapp.MediaFile{}, fmt.Errorf("file is larger than %d bytes", max)
+	}
+
+	bytes, err := ioutil.ReadAll(io.LimitReader(res.Body, maxUploadSize+1))
+	if err != nil {
+		return whapp.MediaFile{}, err
+	} else if len(bytes) > maxUploadSize {
+		return whapp.MediaFile{}, fmt.Errorf("file is larger than %d bytes", maxUploadSize)
+	} else if len(bytes) == 0 {
+		return whapp.MediaFile{}, fmt.Errorf("file is empty")
+	}
+
+	mimeType := headerType
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType, _, _ = mime.ParseMediaType(http.DetectContentType(bytes))
+	}
+	if mimeType == "text/html" {
+		return whapp.MediaFile{}, errNotAFile
+	} else if max := whapp.MaxFileSize(mimeType); int64(len(bytes)) > max {
+		return whapp.MediaFile{}, fmt.Errorf("file is larger than %d bytes", max)
+	}
+
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		name = "file"
+		if ext := util.GetExtensionByMimeOrBytes(mimeType, bytes); ext != "" {
+			name += "." + ext
+		}
+	}
+
+	return whapp.MediaFile{
+		Name:     name,
+		MimeType: mimeType,
+		Bytes:    bytes,
+	}, nil
+}
+
+// newUploadToken returns a new random token for uploading files to the file
+// server.
+func newUploadToken() (string, error) {
+	bytes := make([]byte, 24)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// authenticateUpload returns whether or not the given credentials, of an
+// upload to the file server, are valid. The password is either the upload
+// token or the IRC password of the user.
+func authenticateUpload(nick, pass string) bool {
+	var user types.User
+	if found, err := userDb.GetItem(nick, &user); err != nil || !found {
+		return false
+	}
+
+	if user.UploadToken != "" &&
+		subtle.ConstantTimeCompare([]byte(user.UploadToken), []byte(pass)) == 1 {
+		return true
+	}
+	return user.CheckPassword(pass)
+}
+
+// fileHostToken returns the draft/FILEHOST ISUPPORT token, prefixed by a space,
+// advertising the upload endpoint of the file server.
+func fileHostToken() string {
+	if fs.Authenticate == nil {
+		return ""
+	}
+	return " draft/FILEHOST=" + fs.UploadURL()
+}
+
+// readLocalFile reads the file on our own file server with the given URL.
+func readLocalFile(u *url.URL) (whapp.MediaFile, bool, error) {
+	f, has := fs.GetFileByURL(u.String())
+	if !has {
+		return whapp.MediaFile{}, false, nil
+	}
+
+	bytes, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return whapp.MediaFile{}, true, err
+	}
+
+	name := f.Metadata.Filename
+	if name == "" {
+		name = path.Base(f.Path)
+	}
+	mimeType := f.Metadata.MimeType
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(path.Ext(name))
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(bytes)
+	}
+	mimeType, _, _ = mime.ParseMediaType(mimeType)
+
+	return whapp.MediaFile{
+		Name:     name,
+		MimeType: mimeType,
+		Bytes:    bytes,
+	}, true, nil
+}
+
+// isUpload returns whether or not sendMessageOrUpload would try to upload a file
+// for the given body.
+func isUpload(body string) bool {
+	u, _ := parseUpload(body)
+	return u != nil
+}
+
+// sendMessageOrUpload sends the given body to the given chat. If the body
+// starts with a URL to a file on our own file server or on an allowed host,
+// the file is sent as a media message instead, with the rest of the body as
+// caption.
+func (conn *Connection) sendMessageOrUpload(
+	ctx context.Context,
+	item types.ChatListItem,
+	body string,
+) (whapp.MessageID, error) {
+	u, caption := parseUpload(body)
+	if u == nil {
+		return conn.WI.SendMessageToChatID(ctx, item.ID, body)
+	}
+
+	file, local, err := readLocalFile(u)
+	if !local && isFileServerURL(u) {
+		err = errors.New("file not found on the file server")
+	} else if !local {
+		file, err = fetchUpload(ctx, u)
+	}
+	if err == errNotAFile {
+		return conn.WI.SendMessageToChatID(ctx, item.ID, body)
+	} else if err != nil {
+		return whapp.MessageID{}, fmt.Errorf("error while fetching %s: %s", u, err)
+	}
+
+	return conn.WI.SendMediaToChatID(ctx, item.ID, file, caption)
+}
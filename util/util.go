@@ -1,6 +1,7 @@
 package util
 
 import (
+	"fmt"
 	"log"
 	"mime"
 	"time"
@@ -47,6 +48,23 @@ func Plural(count int, singular, plural string) string {
 	return plural
 }
 
+// FormatSize returns the given amount of bytes in a human readable form, such
+// as 1.5 MB.
+func FormatSize(bytes int64) string {
+	if bytes < 1024 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	size := float64(bytes) / 1024
+	for _, unit := range []string{"KB", "MB", "GB"} {
+		if size < 1024 || unit == "GB" {
+			return fmt.Sprintf("%.1f %s", size, unit)
+		}
+		size /= 1024
+	}
+	return ""
+}
+
 // LogMessage logs the given chat message to the log.
 func LogMessage(time time.Time, from, to, message string) {
 	timeStr := time.Format("2006-01-02 15:04:05")
@@ -0,0 +1,83 @@
+package whapp
+
+import (
+	"context"
+	"time"
+)
+
+// Backend is the interface between whapp-irc and a WhatsApp Web session.
+// Instance, which puppeteers a chromium instance using chromedp, is the default
+// implementation.
+type Backend interface {
+	// Navigate opens WhatsApp Web, without checking the login state.
+	Navigate(ctx context.Context) error
+	// Open opens WhatsApp Web and returns the current login state.
+	Open(ctx context.Context) (LoginState, error)
+	// GetLocalStorage returns the persistent session state.
+	GetLocalStorage(ctx context.Context) (map[string]string, error)
+	// SetLocalStorage restores the persistent session state.
+	SetLocalStorage(ctx context.Context, localStorage map[string]string) error
+	// GetLoginCode returns the code to be shown as a QR code to log in.
+	GetLoginCode(ctx context.Context) (string, error)
+	// WaitLogin waits until the user has logged in.
+	WaitLogin(ctx context.Context) error
+	// GetMe returns information about the logged in user.
+	GetMe(ctx context.Context) (Me, error)
+	// ListenLoggedIn sends changes in the login state.
+	ListenLoggedIn(ctx context.Context, interval time.Duration) (<-chan bool, <-chan error)
+
+	// ListenForMessages sends new incoming and outgoing messages.
+	ListenForMessages(ctx context.Context, interval time.Duration) (<-chan Message, <-chan error)
+	// SendMessageToChatID sends the given text message to the given chat and
+	// returns the ID of the new message once it has been accepted.
+	SendMessageToChatID(ctx context.Context, chatID ID, message string) (MessageID, error)
+	// SendReplyToChatID sends the given text message to the given chat, as a
+	// reply to the message with the given ID, and returns the ID of the new
+	// message.
+	SendReplyToChatID(ctx context.Context, chatID ID, message string, quotedID MessageID) (MessageID, error)
+	// SendMediaToChatID sends the given file to the given chat as a media
+	// message with the given caption, and returns the ID of the new message.
+	SendMediaToChatID(ctx context.Context, chatID ID, file MediaFile, caption string) (MessageID, error)
+	// ListenForAcks sends changes in the acknowledgement state of messages, it
+	// returns ErrNoPush if the backend doesn't support this.
+	ListenForAcks(ctx context.Context) (<-chan Ack, <-chan error)
+	// ListenForReactions sends reactions to messages, it returns ErrNoPush
+	// if the backend doesn't support this.
+	ListenForReactions(ctx context.Context) (<-chan Reaction, <-chan error)
+	// SendReaction reacts to the given message, an empty reaction removes
+	// the current one.
+	SendReaction(ctx context.Context, msgID MessageID, reaction string) error
+	// ListenForChatStates sends changes in the chat states of contacts, it
+	// returns ErrNoPush if the backend doesn't support this.
+	ListenForChatStates(ctx context.Context) (<-chan ChatState, <-chan error)
+	// DownloadMedia downloads and decrypts the media attached to msg.
+	DownloadMedia(ctx context.Context, msg Message) ([]byte, error)
+
+	// GetAllChats returns all chats the user participates in.
+	GetAllChats(ctx context.Context) ([]Chat, error)
+	// GetParticipants returns the participants of the given group chat.
+	GetParticipants(ctx context.Context, chatID ID) ([]Participant, error)
+	// GetPresence returns the presence of the given private chat.
+	GetPresence(ctx context.Context, chatID ID) (Presence, error)
+	// GetMessagesFromChatTillDate returns the messages in the given chat with
+	// a timestamp equal to or greater than timestamp.
+	GetMessagesFromChatTillDate(ctx context.Context, chatID ID, timestamp int64) ([]Message, error)
+	// SendSeen marks all messages in the given chat as read.
+	SendSeen(ctx context.Context, chatID ID) error
+	// SendChatState sets the chat state of the user in the given chat.
+	SendChatState(ctx context.Context, chatID ID, state string) error
+	// GetCommonGroups returns the group chats shared with the given contact.
+	GetCommonGroups(ctx context.Context, contactID ID) ([]Chat, error)
+
+	// SetAdmin sets the admin state of the given user in the given chat.
+	SetAdmin(ctx context.Context, chatID, userID ID, setAdmin bool) error
+	// AddParticipant adds the given user to the given chat.
+	AddParticipant(ctx context.Context, chatID, userID ID) error
+	// RemoveParticipant removes the given user from the given chat.
+	RemoveParticipant(ctx context.Context, chatID, userID ID) error
+
+	// Shutdown stops the backend and releases its resources.
+	Shutdown(ctx context.Context) error
+}
+
+var _ Backend = (*Instance)(nil)
@@ -0,0 +1,170 @@
+package whapp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/chromedp/chromedp"
+)
+
+// GetParticipants retrieves and returns a slice containing all participants
+// of the group chat with the given chatID.
+func (wi *Instance) GetParticipants(ctx context.Context, chatID ID) ([]Participant, error) {
+	var res []Participant
+
+	if wi.LoginState != Loggedin {
+		return res, ErrLoggedOut
+	}
+
+	if err := wi.inject(ctx); err != nil {
+		return res, err
+	}
+
+	str := fmt.Sprintf("whappGo.getGroupParticipants(%s)", strconv.Quote(chatID.String()))
+
+	err := wi.cdp.Run(ctx, chromedp.Evaluate(str, &res, awaitPromise))
+	if err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// GetPresence retrieves and returns the presence of the private chat with the
+// given chatID.
+func (wi *Instance) GetPresence(ctx context.Context, chatID ID) (Presence, error) {
+	// TODO REVIEW
+
+	var res Presence
+
+	if wi.LoginState != Loggedin {
+		return res, ErrLoggedOut
+	}
+
+	if err := wi.inject(ctx); err != nil {
+		return res, err
+	}
+
+	str := fmt.Sprintf("whappGo.getPresence(%s)", strconv.Quote(chatID.String()))
+
+	err := wi.cdp.Run(ctx, chromedp.Evaluate(str, &res, awaitPromise))
+	if err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// SetAdmin sets the admin state of the user with given userID in the chat with
+// the given chatID.
+func (wi *Instance) SetAdmin(ctx context.Context, chatID, userID ID, setAdmin bool) error {
+	str := fmt.Sprintf(
+		"whappGo.setAdmin(%s, %s, %t)",
+		strconv.Quote(chatID.String()),
+		strconv.Quote(userID.String()),
+		setAdmin,
+	)
+	return runLoggedinWithoutRes(ctx, wi, str, false) // TODO: true?
+}
+
+// AddParticipant adds the user with the given userID to the chat with the
+// given chatID.
+func (wi *Instance) AddParticipant(ctx context.Context, chatID, userID ID) error {
+	str := fmt.Sprintf(
+		"whappGo.addParticipant(%s, %s)",
+		strconv.Quote(chatID.String()),
+		strconv.Quote(userID.String()),
+	)
+	return runLoggedinWithoutRes(ctx, wi, str, false) // TODO: true?
+}
+
+// RemoveParticipant removes the user with the given userID from the chat with
+// the given chatID.
+func (wi *Instance) RemoveParticipant(ctx context.Context, chatID, userID ID) error {
+	str := fmt.Sprintf(
+		"whappGo.removeParticipant(%s, %s)",
+		strconv.Quote(chatID.String()),
+		strconv.Quote(userID.String()),
+	)
+	return runLoggedinWithoutRes(ctx, wi, str, false) // TODO: true?
+}
+
+// SendSeen marks all messages in the chat with the given chatID as read, which
+// sends read receipts to their senders.
+func (wi *Instance) SendSeen(ctx context.Context, chatID ID) error {
+	str := fmt.Sprintf("whappGo.sendSeen(%s)", strconv.Quote(chatID.String()))
+	return runLoggedinWithoutRes(ctx, wi, str, true)
+}
+
+// SendChatState sets the chat state of the user in the chat with the given
+// chatID, state is one of the ChatState* constants.
+func (wi *Instance) SendChatState(ctx context.Context, chatID ID, state string) error {
+	str := fmt.Sprintf(
+		"whappGo.sendChatState(%s, %s)",
+		strconv.Quote(chatID.String()),
+		strconv.Quote(state),
+	)
+	return runLoggedinWithoutRes(ctx, wi, str, true)
+}
+
+// GetMessagesFromChatTillDate returns messages in the chat with the given
+// chatID with a timestamp equal to or greater than `timestamp`.
+func (wi *Instance) GetMessagesFromChatTillDate(
+	ctx context.Context,
+	chatID ID,
+	timestamp int64,
+) ([]Message, error) {
+	var res []Message
+
+	if wi.LoginState != Loggedin {
+		return res, ErrLoggedOut
+	}
+
+	if err := wi.inject(ctx); err != nil {
+		return res, err
+	}
+
+	str := fmt.Sprintf(
+		"whappGo.getMessagesFromChatTillDate(%s, %d)",
+		strconv.Quote(chatID.String()),
+		timestamp,
+	)
+	if err := wi.cdp.Run(
+		ctx,
+		chromedp.Evaluate(str, &res, awaitPromise),
+	); err != nil {
+		return res, err
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Timestamp < res[j].Timestamp
+	})
+
+	return res, nil
+}
+
+// GetCommonGroups gets the groups both the logged-in user and the contact with
+// the given contactID are in.
+func (wi *Instance) GetCommonGroups(ctx context.Context, contactID ID) ([]Chat, error) {
+	var res []Chat
+
+	if wi.LoginState != Loggedin {
+		return res, ErrLoggedOut
+	}
+
+	if err := wi.inject(ctx); err != nil {
+		return res, err
+	}
+
+	str := fmt.Sprintf("whappGo.getCommonGroups(%s)", strconv.Quote(contactID.String()))
+
+	err := wi.cdp.Run(ctx, chromedp.Evaluate(str, &res, awaitPromise))
+	return res, err
+}
+
+// DownloadMedia downloads the media included in the given message, if any.
+func (wi *Instance) DownloadMedia(ctx context.Context, msg Message) ([]byte, error) {
+	return msg.DownloadMedia()
+}
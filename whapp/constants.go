@@ -1,5 +1,7 @@
 package whapp
 
+import "strings"
+
 const url = "https://web.whatsapp.com"
 const userAgent = "Mozilla/5.0 (Windows NT 5.1) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/61.0.3163.100 Safari/537.36"
 
@@ -12,6 +14,23 @@ var cryptKeys = map[string]string{
 	"document": "576861747341707020446f63756d656e74204b657973",
 }
 
+// The maximum sizes in bytes of files WhatsApp accepts, images, videos and
+// audio are limited to MaxMediaSize, documents to MaxDocumentSize.
+const (
+	MaxMediaSize    = 16 * 1024 * 1024
+	MaxDocumentSize = 100 * 1024 * 1024
+)
+
+// MaxFileSize returns the maximum size in bytes of a file with the given mime
+// type WhatsApp accepts.
+func MaxFileSize(mimeType string) int64 {
+	switch strings.SplitN(mimeType, "/", 2)[0] {
+	case "image", "video", "audio":
+		return MaxMediaSize
+	}
+	return MaxDocumentSize
+}
+
 func getCryptKey(typ string) string {
 	if res, found := cryptKeys[typ]; found {
 		return res
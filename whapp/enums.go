@@ -19,3 +19,21 @@ const (
 	// LogLevelNormal is the normal level of logging verbosity.
 	LogLevelNormal = iota
 )
+
+// The acknowledgement states of a message, as found in Message.Ack and Ack.
+const (
+	AckError     = -1
+	AckPending   = 0
+	AckSent      = 1
+	AckDelivered = 2
+	AckRead      = 3
+	AckPlayed    = 4
+)
+
+// The chat states of a contact, as found in ChatState.
+const (
+	ChatStateComposing = "composing"
+	ChatStateRecording = "recording"
+	ChatStatePaused    = "paused"
+	ChatStateAvailable = "available"
+)
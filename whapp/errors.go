@@ -13,3 +13,8 @@ var ErrLoggedOut = errors.New("logged out, should be logged in")
 // ErrCDPUnknown will be returned in some cases as an error when the called
 // function/method encountered an unknown error with CDP.
 var ErrCDPUnknown = errors.New("unknown CDP error")
+
+// ErrNoPush will be returned as an error when the called function/method
+// requires events to be pushed by the injected script, but this isn't
+// supported.
+var ErrNoPush = errors.New("pushing events is not supported")
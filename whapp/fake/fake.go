@@ -0,0 +1,799 @@
+// Package fake implements an in-memory, scriptable whapp.Backend. It's meant to
+// be used in tests, where running chromium and a real phone isn't an option.
+package fake
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"whapp-irc/whapp"
+)
+
+// Call is a recorded call to a mutating method of the Backend.
+type Call struct {
+	Method string
+	ChatID whapp.ID
+	UserID whapp.ID
+	Admin  bool
+}
+
+// SentMessage is a message sent using SendMessageToChatID or
+// SendReplyToChatID, QuotedID is empty for the former.
+type SentMessage struct {
+	ChatID   whapp.ID
+	Body     string
+	QuotedID string
+}
+
+// SentMedia is a media message sent using SendMediaToChatID.
+type SentMedia struct {
+	ChatID  whapp.ID
+	File    whapp.MediaFile
+	Caption string
+}
+
+// Backend is an in-memory whapp.Backend. The zero value isn't usable, use New.
+type Backend struct {
+	mu sync.Mutex
+
+	me           whapp.Me
+	loginState   whapp.LoginState
+	localStorage map[string]string
+
+	chats        []whapp.Chat
+	participants map[whapp.ID][]whapp.Participant
+	presences    map[whapp.ID]whapp.Presence
+	commonGroups map[whapp.ID][]whapp.ID
+	history      map[whapp.ID][]whapp.Message
+	media        map[string][]byte
+
+	calls      []Call
+	sent       []SentMessage
+	sentMedia  []SentMedia
+	sendErr    error
+	reactions  []whapp.Reaction
+	chatStates []whapp.ChatState
+
+	nextID     int
+	messageCh  chan whapp.Message
+	ackCh      chan whapp.Ack
+	reactionCh chan whapp.Reaction
+	stateCh    chan whapp.ChatState
+	loggedInCh chan bool
+	resetCh    chan whapp.ResetReason
+}
+
+// New returns a new Backend for the user me, which is already logged in.
+func New(me whapp.Me) *Backend {
+	return &Backend{
+		me:           me,
+		loginState:   whapp.Loggedin,
+		localStorage: make(map[string]string),
+
+		participants: make(map[whapp.ID][]whapp.Participant),
+		presences:    make(map[whapp.ID]whapp.Presence),
+		commonGroups: make(map[whapp.ID][]whapp.ID),
+		history:      make(map[whapp.ID][]whapp.Message),
+		media:        make(map[string][]byte),
+
+		messageCh:  make(chan whapp.Message, 100),
+		ackCh:      make(chan whapp.Ack, 100),
+		reactionCh: make(chan whapp.Reaction, 100),
+		stateCh:    make(chan whapp.ChatState, 100),
+		loggedInCh: make(chan bool, 10),
+		resetCh:    make(chan whapp.ResetReason, 1),
+	}
+}
+
+// AddChat adds the given chat, with the given participants if it's a group
+// chat, to the backend.
+func (b *Backend) AddChat(chat whapp.Chat, participants ...whapp.Participant) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.chats = append(b.chats, chat)
+	b.participants[chat.ID] = participants
+}
+
+// SetPresence sets the presence returned for the chat with the given ID.
+func (b *Backend) SetPresence(chatID whapp.ID, presence whapp.Presence) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.presences[chatID] = presence
+}
+
+// SetCommonGroups sets the group chats the contact with the given ID shares
+// with the user.
+func (b *Backend) SetCommonGroups(contactID whapp.ID, chatIDs ...whapp.ID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.commonGroups[contactID] = chatIDs
+}
+
+// AddMedia registers the given blob, it will be returned by DownloadMedia for
+// messages with the given file hash.
+func (b *Backend) AddMedia(hash string, bytes []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.media[hash] = bytes
+}
+
+// AddHistory adds the given message to the history of its chat, without
+// delivering it as a new message.
+func (b *Backend) AddHistory(msg whapp.Message) whapp.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.addHistory(msg)
+}
+
+func (b *Backend) addHistory(msg whapp.Message) whapp.Message {
+	if msg.ID.Serialized == "" {
+		b.nextID++
+		msg.ID = whapp.MessageID{
+			FromMe: msg.IsSentByMe,
+			ChatID: msg.Chat.ID,
+			ID:     strconv.Itoa(b.nextID),
+		}
+		msg.ID.Serialized = fmt.Sprintf(
+			"%t_%s_%s",
+			msg.ID.FromMe,
+			msg.ID.ChatID,
+			msg.ID.ID,
+		)
+	}
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().Unix()
+	}
+
+	for i, chat := range b.chats {
+		if chat.ID == msg.Chat.ID && msg.Timestamp > chat.Timestamp {
+			b.chats[i].Timestamp = msg.Timestamp
+		}
+	}
+
+	b.history[msg.Chat.ID] = append(b.history[msg.Chat.ID], msg)
+	return msg
+}
+
+// Receive adds the given message to the history of its chat and delivers it
+// to the listener of ListenForMessages.
+func (b *Backend) Receive(msg whapp.Message) whapp.Message {
+	b.mu.Lock()
+	msg = b.addHistory(msg)
+	b.mu.Unlock()
+
+	b.messageCh <- msg
+	return msg
+}
+
+// Notify delivers a group notification (gp2) with the given subtype, such as
+// "add", "remove" or "leave", in the given chat.
+func (b *Backend) Notify(
+	chat whapp.Chat,
+	subtype string,
+	author whapp.ID,
+	recipients ...whapp.ID,
+) whapp.Message {
+	return b.Receive(whapp.Message{
+		Type:           "gp2",
+		Subtype:        subtype,
+		From:           author,
+		RecipientIDs:   recipients,
+		IsNotification: true,
+		Chat:           chat,
+	})
+}
+
+// FailSending makes sending messages fail with the given error, or succeed
+// again if err is nil.
+func (b *Backend) FailSending(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sendErr = err
+}
+
+// SetAck changes the acknowledgement state of the message with the given ID and
+// delivers the change to the listener of ListenForAcks.
+func (b *Backend) SetAck(id whapp.MessageID, ack int) {
+	b.mu.Lock()
+	for chatID, messages := range b.history {
+		for i, msg := range messages {
+			if msg.ID.Serialized == id.Serialized {
+				b.history[chatID][i].Ack = ack
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	b.ackCh <- whapp.Ack{ID: id, Ack: ack}
+}
+
+// React delivers the given reaction to the listener of ListenForReactions.
+func (b *Backend) React(reaction whapp.Reaction) {
+	if reaction.Timestamp == 0 {
+		reaction.Timestamp = time.Now().Unix()
+	}
+	b.reactionCh <- reaction
+}
+
+// SetChatState delivers the given chat state to the listener of
+// ListenForChatStates.
+func (b *Backend) SetChatState(state whapp.ChatState) {
+	b.stateCh <- state
+}
+
+// SetLoggedIn changes the login state, as if the user logged out using their
+// phone.
+func (b *Backend) SetLoggedIn(loggedIn bool) {
+	b.loggedInCh <- loggedIn
+}
+
+// SetLoginState sets the login state returned by Open, for example to simulate
+// the session being logged out on the phone.
+func (b *Backend) SetLoginState(state whapp.LoginState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.loginState = state
+}
+
+// Reset reports that the state of the backend has been lost for the given
+// reason, on the channel returned by Resets.
+func (b *Backend) Reset(reason whapp.ResetReason) {
+	b.resetCh <- reason
+}
+
+// Resets returns a channel receiving the resets sent using Reset.
+func (b *Backend) Resets() <-chan whapp.ResetReason {
+	return b.resetCh
+}
+
+// LoggedIn returns whether or not the user is logged in.
+func (b *Backend) LoggedIn() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.loginState == whapp.Loggedin
+}
+
+// Calls returns the recorded calls to the mutating methods.
+func (b *Backend) Calls() []Call {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res := make([]Call, len(b.calls))
+	copy(res, b.calls)
+	return res
+}
+
+// Sent returns the messages sent using SendMessageToChatID.
+func (b *Backend) Sent() []SentMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res := make([]SentMessage, len(b.sent))
+	copy(res, b.sent)
+	return res
+}
+
+// SentMedia returns the media messages sent using SendMediaToChatID.
+func (b *Backend) SentMedia() []SentMedia {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res := make([]SentMedia, len(b.sentMedia))
+	copy(res, b.sentMedia)
+	return res
+}
+
+// Reactions returns the reactions sent using SendReaction.
+func (b *Backend) Reactions() []whapp.Reaction {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res := make([]whapp.Reaction, len(b.reactions))
+	copy(res, b.reactions)
+	return res
+}
+
+// ChatStates returns the chat states sent using SendChatState.
+func (b *Backend) ChatStates() []whapp.ChatState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res := make([]whapp.ChatState, len(b.chatStates))
+	copy(res, b.chatStates)
+	return res
+}
+
+// Navigate implements whapp.Backend.
+func (b *Backend) Navigate(ctx context.Context) error {
+	return nil
+}
+
+// Open implements whapp.Backend.
+func (b *Backend) Open(ctx context.Context) (whapp.LoginState, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.loginState, nil
+}
+
+// GetLocalStorage implements whapp.Backend.
+func (b *Backend) GetLocalStorage(ctx context.Context) (map[string]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res := make(map[string]string)
+	for k, v := range b.localStorage {
+		res[k] = v
+	}
+	return res, nil
+}
+
+// SetLocalStorage implements whapp.Backend.
+func (b *Backend) SetLocalStorage(ctx context.Context, localStorage map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for k, v := range localStorage {
+		b.localStorage[k] = v
+	}
+	return nil
+}
+
+// GetLoginCode implements whapp.Backend.
+func (b *Backend) GetLoginCode(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.loginState == whapp.Loggedin {
+		return "", whapp.ErrLoggedIn
+	}
+	return "fake-login-code", nil
+}
+
+// WaitLogin implements whapp.Backend.
+func (b *Backend) WaitLogin(ctx context.Context) error {
+	return nil
+}
+
+// GetMe implements whapp.Backend.
+func (b *Backend) GetMe(ctx context.Context) (whapp.Me, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.me, nil
+}
+
+// ListenLoggedIn implements whapp.Backend, changes are sent using SetLoggedIn.
+func (b *Backend) ListenLoggedIn(ctx context.Context, interval time.Duration) (<-chan bool, <-chan error) {
+	errCh := make(chan error)
+	resCh := make(chan bool)
+
+	go func() {
+		defer close(resCh)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case res := <-b.loggedInCh:
+				select {
+				case <-ctx.Done():
+					return
+				case resCh <- res:
+				}
+			}
+		}
+	}()
+
+	return resCh, errCh
+}
+
+// ListenForMessages implements whapp.Backend, messages are sent using Receive
+// and Notify.
+func (b *Backend) ListenForMessages(ctx context.Context, interval time.Duration) (<-chan whapp.Message, <-chan error) {
+	errCh := make(chan error)
+	messageCh := make(chan whapp.Message)
+
+	go func() {
+		defer close(messageCh)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case msg := <-b.messageCh:
+				select {
+				case <-ctx.Done():
+					return
+				case messageCh <- msg:
+				}
+			}
+		}
+	}()
+
+	return messageCh, errCh
+}
+
+// ListenForAcks implements whapp.Backend, changes are sent using SetAck.
+func (b *Backend) ListenForAcks(ctx context.Context) (<-chan whapp.Ack, <-chan error) {
+	errCh := make(chan error)
+	ackCh := make(chan whapp.Ack)
+
+	go func() {
+		defer close(ackCh)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case ack := <-b.ackCh:
+				select {
+				case <-ctx.Done():
+					return
+				case ackCh <- ack:
+				}
+			}
+		}
+	}()
+
+	return ackCh, errCh
+}
+
+// ListenForReactions implements whapp.Backend, reactions are sent using React.
+func (b *Backend) ListenForReactions(ctx context.Context) (<-chan whapp.Reaction, <-chan error) {
+	errCh := make(chan error)
+	reactionCh := make(chan whapp.Reaction)
+
+	go func() {
+		defer close(reactionCh)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case reaction := <-b.reactionCh:
+				select {
+				case <-ctx.Done():
+					return
+				case reactionCh <- reaction:
+				}
+			}
+		}
+	}()
+
+	return reactionCh, errCh
+}
+
+// ListenForChatStates implements whapp.Backend, chat states are sent using
+// SetChatState.
+func (b *Backend) ListenForChatStates(ctx context.Context) (<-chan whapp.ChatState, <-chan error) {
+	errCh := make(chan error)
+	stateCh := make(chan whapp.ChatState)
+
+	go func() {
+		defer close(stateCh)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case state := <-b.stateCh:
+				select {
+				case <-ctx.Done():
+					return
+				case stateCh <- state:
+				}
+			}
+		}
+	}()
+
+	return stateCh, errCh
+}
+
+// SendMessageToChatID implements whapp.Backend, the message is added to the
+// history of the chat and delivered to the listener of ListenForMessages, like
+// WhatsApp Web does.
+func (b *Backend) SendMessageToChatID(ctx context.Context, chatID whapp.ID, message string) (whapp.MessageID, error) {
+	return b.send(chatID, message, whapp.MessageID{})
+}
+
+// SendReplyToChatID implements whapp.Backend, like SendMessageToChatID.
+func (b *Backend) SendReplyToChatID(
+	ctx context.Context,
+	chatID whapp.ID,
+	message string,
+	quotedID whapp.MessageID,
+) (whapp.MessageID, error) {
+	return b.send(chatID, message, quotedID)
+}
+
+func (b *Backend) send(chatID whapp.ID, message string, quotedID whapp.MessageID) (whapp.MessageID, error) {
+	return b.sendMsg(chatID, whapp.Message{Type: "chat", Body: message}, func() {
+		b.sent = append(b.sent, SentMessage{chatID, message, quotedID.Serialized})
+	})
+}
+
+// SendMediaToChatID implements whapp.Backend, like SendMessageToChatID. The
+// file is added to the media returned by DownloadMedia.
+func (b *Backend) SendMediaToChatID(
+	ctx context.Context,
+	chatID whapp.ID,
+	file whapp.MediaFile,
+	caption string,
+) (whapp.MessageID, error) {
+	if max := whapp.MaxFileSize(file.MimeType); int64(len(file.Bytes)) > max {
+		return whapp.MessageID{}, fmt.Errorf("file is larger than %d bytes", max)
+	}
+
+	sum := sha256.Sum256(file.Bytes)
+	hash := base64.StdEncoding.EncodeToString(sum[:])
+
+	msg := whapp.Message{
+		Type:          "document",
+		IsMMS:         true,
+		IsMedia:       true,
+		MimeType:      file.MimeType,
+		MediaFileHash: hash,
+		MediaFilename: file.Name,
+		Caption:       caption,
+	}
+	return b.sendMsg(chatID, msg, func() {
+		b.sentMedia = append(b.sentMedia, SentMedia{chatID, file, caption})
+		b.media[hash] = file.Bytes
+	})
+}
+
+// sendMsg sends msg from the user in the chat with the given ID, record is
+// called with b.mu held when sending succeeds.
+func (b *Backend) sendMsg(chatID whapp.ID, msg whapp.Message, record func()) (whapp.MessageID, error) {
+	b.mu.Lock()
+
+	chat, ok := b.chat(chatID)
+	if !ok {
+		b.mu.Unlock()
+		return whapp.MessageID{}, fmt.Errorf("no chat with id %s found", chatID)
+	} else if b.sendErr != nil {
+		b.mu.Unlock()
+		return whapp.MessageID{}, b.sendErr
+	}
+
+	record()
+
+	msg.Sender = &whapp.Contact{ID: b.me.SelfID, IsMe: true}
+	msg.From = b.me.SelfID
+	msg.IsSentByMe = true
+	msg.IsSentByMeFromWeb = true
+	msg.Ack = whapp.AckSent
+	msg.Chat = chat
+	msg = b.addHistory(msg)
+	b.mu.Unlock()
+
+	b.messageCh <- msg
+	return msg.ID, nil
+}
+
+// SendReaction implements whapp.Backend, it fails if the message isn't in the
+// history of any chat.
+func (b *Backend) SendReaction(ctx context.Context, msgID whapp.MessageID, reaction string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, messages := range b.history {
+		for _, msg := range messages {
+			if msg.ID.Serialized != msgID.Serialized {
+				continue
+			}
+
+			b.reactions = append(b.reactions, whapp.Reaction{
+				MessageID: msgID.Serialized,
+				SenderID:  b.me.SelfID,
+				Reaction:  reaction,
+				Timestamp: time.Now().Unix(),
+			})
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no message with id %s found", msgID.Serialized)
+}
+
+// DownloadMedia implements whapp.Backend, it returns the blob registered using
+// AddMedia.
+func (b *Backend) DownloadMedia(ctx context.Context, msg whapp.Message) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bytes, ok := b.media[msg.MediaFileHash]
+	if !ok {
+		return nil, fmt.Errorf("no media with hash %s found", msg.MediaFileHash)
+	}
+	return bytes, nil
+}
+
+func (b *Backend) chat(chatID whapp.ID) (whapp.Chat, bool) {
+	for _, chat := range b.chats {
+		if chat.ID == chatID {
+			return chat, true
+		}
+	}
+	return whapp.Chat{}, false
+}
+
+// GetAllChats implements whapp.Backend.
+func (b *Backend) GetAllChats(ctx context.Context) ([]whapp.Chat, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res := make([]whapp.Chat, len(b.chats))
+	copy(res, b.chats)
+	return res, nil
+}
+
+// GetParticipants implements whapp.Backend.
+func (b *Backend) GetParticipants(ctx context.Context, chatID whapp.ID) ([]whapp.Participant, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	participants, ok := b.participants[chatID]
+	if !ok {
+		return nil, fmt.Errorf("no chat with id %s found", chatID)
+	}
+
+	res := make([]whapp.Participant, len(participants))
+	copy(res, participants)
+	return res, nil
+}
+
+// GetPresence implements whapp.Backend.
+func (b *Backend) GetPresence(ctx context.Context, chatID whapp.ID) (whapp.Presence, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if presence, ok := b.presences[chatID]; ok {
+		return presence, nil
+	}
+	return whapp.Presence{ID: chatID, IsOnline: true}, nil
+}
+
+// GetMessagesFromChatTillDate implements whapp.Backend.
+func (b *Backend) GetMessagesFromChatTillDate(
+	ctx context.Context,
+	chatID whapp.ID,
+	timestamp int64,
+) ([]whapp.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var res []whapp.Message
+	for _, msg := range b.history[chatID] {
+		if msg.Timestamp >= timestamp {
+			res = append(res, msg)
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Timestamp < res[j].Timestamp
+	})
+
+	return res, nil
+}
+
+// GetCommonGroups implements whapp.Backend.
+func (b *Backend) GetCommonGroups(ctx context.Context, contactID whapp.ID) ([]whapp.Chat, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var res []whapp.Chat
+	for _, id := range b.commonGroups[contactID] {
+		if chat, ok := b.chat(id); ok {
+			res = append(res, chat)
+		}
+	}
+	return res, nil
+}
+
+// SendSeen implements whapp.Backend, the call is recorded.
+func (b *Backend) SendSeen(ctx context.Context, chatID whapp.ID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.chat(chatID); !ok {
+		return fmt.Errorf("no chat with id %s found", chatID)
+	}
+
+	b.calls = append(b.calls, Call{Method: "SendSeen", ChatID: chatID})
+	return nil
+}
+
+// SendChatState implements whapp.Backend, the chat state is recorded.
+func (b *Backend) SendChatState(ctx context.Context, chatID whapp.ID, state string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.chat(chatID); !ok {
+		return fmt.Errorf("no chat with id %s found", chatID)
+	}
+
+	b.chatStates = append(b.chatStates, whapp.ChatState{
+		ChatID:   chatID,
+		SenderID: b.me.SelfID,
+		State:    state,
+	})
+	return nil
+}
+
+// SetAdmin implements whapp.Backend.
+func (b *Backend) SetAdmin(ctx context.Context, chatID, userID whapp.ID, setAdmin bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.calls = append(b.calls, Call{"SetAdmin", chatID, userID, setAdmin})
+
+	for i, p := range b.participants[chatID] {
+		if p.ID == userID {
+			b.participants[chatID][i].IsAdmin = setAdmin
+			return nil
+		}
+	}
+	return fmt.Errorf("no participant with id %s found", userID)
+}
+
+// AddParticipant implements whapp.Backend.
+func (b *Backend) AddParticipant(ctx context.Context, chatID, userID whapp.ID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.calls = append(b.calls, Call{Method: "AddParticipant", ChatID: chatID, UserID: userID})
+
+	contact := whapp.Contact{ID: userID}
+	if chat, ok := b.chat(userID); ok {
+		contact = chat.Contact
+	}
+	b.participants[chatID] = append(b.participants[chatID], whapp.Participant{
+		ID:      userID,
+		Contact: contact,
+	})
+	return nil
+}
+
+// RemoveParticipant implements whapp.Backend.
+func (b *Backend) RemoveParticipant(ctx context.Context, chatID, userID whapp.ID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.calls = append(b.calls, Call{Method: "RemoveParticipant", ChatID: chatID, UserID: userID})
+
+	participants := b.participants[chatID]
+	for i, p := range participants {
+		if p.ID == userID {
+			b.participants[chatID] = append(participants[:i:i], participants[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no participant with id %s found", userID)
+}
+
+// Shutdown implements whapp.Backend.
+func (b *Backend) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+var _ whapp.Backend = (*Backend)(nil)
@@ -2,12 +2,19 @@ package whapp
 
 import (
 	"context"
+	"log"
 
 	"github.com/chromedp/chromedp"
 )
 
 func (wi *Instance) inject(ctx context.Context) error {
-	if wi.injected {
+	wi.injectMu.Lock()
+	defer wi.injectMu.Unlock()
+
+	wi.mu.Lock()
+	injected := wi.injected
+	wi.mu.Unlock()
+	if injected {
 		return nil
 	}
 
@@ -37,6 +44,38 @@ func (wi *Instance) inject(ctx context.Context) error {
 		window.Store.Wap = await fetchWebpack('dgfhfgbdeb');
 		window.Store.Conn = (await fetchWebpack('jfefjijii')).default;
 		window.Store.Stream = (await fetchWebpack('djddhaidag')).default;
+
+		// the reaction and media modules don't have a stable id, so we look them up
+		// using the webpack module cache.
+		whappGo.require = await new Promise(function (resolve) {
+			webpackJsonp([], { whappGoRequire: function (x, y, z) { resolve(z); } }, 'whappGoRequire');
+		});
+		window.Store.ReactionsSend = whappGo.findModule(m => typeof m.sendReactionToMsg === 'function');
+		window.Store.Reactions = whappGo.findModule(m => typeof m.createOrUpdateReactions === 'function');
+		const mediaCollection = whappGo.findModule(m => m.default && m.default.prototype && m.default.prototype.processFiles !== undefined);
+		window.Store.MediaCollection = mediaCollection && mediaCollection.default;
+	};
+
+	whappGo.findModule = function (pred) {
+		const cache = whappGo.require && whappGo.require.c;
+		if (cache == null) {
+			return null;
+		}
+
+		for (const key of Object.keys(cache)) {
+			const exports = cache[key] && cache[key].exports;
+			if (exports == null) {
+				continue;
+			}
+
+			if (pred(exports)) {
+				return exports;
+			} else if (exports.default != null && pred(exports.default)) {
+				return exports.default;
+			}
+		}
+
+		return null;
 	};
 
 	whappGo.contactToJSON = function (contact) {
@@ -187,10 +226,7 @@ func (wi *Instance) inject(ctx context.Context) error {
 				}
 				msg.isNewMsg = false;
 
-				if (
-					(msg.isMedia && !msg.clientUrl) ||
-					(msg.type === 'location' && !msg.body)
-				) {
+				if (!whappGo.isMsgReady(msg)) {
 					continue;
 				}
 
@@ -201,23 +237,108 @@ func (wi *Instance) inject(ctx context.Context) error {
 		return res;
 	};
 
-	whappGo.sendMessage = function (id, message, replyID) {
-		/*
-		var splitted = replyID.split('_');
-		var replyObj = {
-			contextInfo: function () {
-				return {
-					"quotedMsg": {
-						"type": "gp2",
-						"subtype": "leave",
-					},
-					"quotedStanzaID": splitted[2],
-					"quotedRemoteJid": splitted[1],
+	whappGo.pushEnabled = false;
+
+	whappGo.push = function (type, data) {
+		window.` + pushBinding + `(JSON.stringify({ type: type, data: data }));
+	};
+
+	whappGo.isMsgReady = function (msg) {
+		return !(
+			(msg.isMedia && !msg.clientUrl) ||
+			(msg.type === 'location' && !msg.body)
+		);
+	};
+
+	whappGo.pushMessage = function (msg) {
+		if (!whappGo.pushEnabled || msg == null || !msg.isNewMsg) {
+			return;
+		}
+
+		// wait until the media or location has been loaded
+		if (!whappGo.isMsgReady(msg)) {
+			msg.once('change', () => whappGo.pushMessage(msg));
+			return;
+		}
+
+		msg.isNewMsg = false;
+		whappGo.push('` + pushMessage + `', whappGo.msgToJSON(msg));
+	};
+
+	whappGo.setupPush = function () {
+		if (typeof window.` + pushBinding + ` !== 'function') {
+			return false;
+		}
+
+		Store.Msg.on('add', whappGo.pushMessage);
+		Store.Msg.on('change:ack', function (msg) {
+			whappGo.push('` + pushAck + `', { id: msg.id, ack: msg.ack });
+		});
+		Store.Conn.on('change:clientToken', function () {
+			whappGo.push('` + pushLoggedIn + `', Store.Conn.clientToken != null);
+		});
+
+		if (Store.Reactions != null) {
+			const createOrUpdate = Store.Reactions.createOrUpdateReactions;
+			Store.Reactions.createOrUpdateReactions = function (reactions) {
+				for (const r of [].concat(reactions)) {
+					whappGo.push('` + pushReaction + `', {
+						msgId: r.parentMsgKey.toString(),
+						senderId: idFromString(r.senderUserJid.toString()),
+						reaction: r.reactionText,
+						t: Math.floor(r.timestamp / 1000),
+					});
 				}
-			},
+				return createOrUpdate.apply(this, arguments);
+			};
+		}
+
+		// private chats have a single chat state, group chats one per
+		// participant.
+		const pushChatState = function (presence, chatstate) {
+			if (chatstate == null || chatstate.type == null) {
+				return;
+			}
+			whappGo.push('` + pushChatState + `', {
+				chatId: presence.id,
+				senderId: chatstate.id || presence.id,
+				state: chatstate.type,
+			});
+		};
+		const listenPresence = function (presence) {
+			presence.on('change:chatstate.type', function () {
+				pushChatState(presence, presence.chatstate);
+			});
+			if (presence.chatstates != null) {
+				presence.chatstates.on('change:type', function (chatstate) {
+					pushChatState(presence, chatstate);
+				});
+			}
 		};
-		*/
+		Store.Presence.models.forEach(listenPresence);
+		Store.Presence.on('add', listenPresence);
+
+		return true;
+	};
 
+	whappGo.enablePush = function () {
+		if (whappGo.pushEnabled) {
+			return;
+		}
+		whappGo.pushEnabled = true;
+
+		// push all messages that came in before we were enabled
+		let messages = [];
+		for (const chat of Store.Chat.models) {
+			if (chat == null) {
+				continue;
+			}
+			messages = messages.concat(chat.msgs.models.filter(m => m != null && m.isNewMsg));
+		}
+		messages.sort((a, b) => a.t - b.t).forEach(whappGo.pushMessage);
+	};
+
+	whappGo.sendMessage = async function (id, message, replyID) {
 		id = idFromString(id);
 
 		const chat = Store.Chat.models.find(c => ideq(c.id, id));
@@ -225,34 +346,105 @@ func (wi *Instance) inject(ctx context.Context) error {
 			throw new Error('no chat with id ' + id + ' found.');
 		}
 
-		function sleep (ms) {
-			return new Promise(resolve => setTimeout(resolve, ms));
+		let quoted = undefined;
+		if (replyID != null) {
+			quoted = Store.Msg.get(replyID);
+			if (quoted == null) {
+				throw new Error('no message with id ' + replyID + ' found.');
+			}
 		}
 
-		chat.sendMessage(message/*, {}, replyObj*/).then(function () {
-			var trials = 0;
+		const existing = new Set(chat.msgs.models);
+		await chat.sendMessage(message, {}, quoted);
 
-			function trySend() {
-				for (let i = chat.msgs.models.length - 1; i >= 0; i--) {
-					let msg = chat.msgs.models[i];
+		return await whappGo.waitForSent(chat, existing, msg => msg.body == message);
+	};
 
-					if (!msg.senderObj.isMe || msg.body != message) {
-						continue;
-					}
+	// waitForSent waits for a message matching pred, that's not in existing,
+	// to show up in the given chat, so we can return its id.
+	whappGo.waitForSent = async function (chat, existing, pred) {
+		function sleep (ms) {
+			return new Promise(resolve => setTimeout(resolve, ms));
+		}
 
-					return true;
+		for (let trials = 0; trials < 40; trials++) { // 20s
+			for (let i = chat.msgs.models.length - 1; i >= 0; i--) {
+				const msg = chat.msgs.models[i];
+				if (existing.has(msg) || !msg.senderObj.isMe || !pred(msg)) {
+					continue;
 				}
 
-				if (++trials > 40) { // 20s
-					// too much trials
-					return;
+				if (msg.ack < 0) {
+					throw new Error('message could not be sent.');
 				}
-
-				sleep(500).then(trySend); // try again
+				return msg.id;
 			}
 
-			trySend();
-		});
+			await sleep(500);
+		}
+
+		throw new Error('message not sent after 20 seconds.');
+	};
+
+	// uploads contains the chunks of the files being sent to the page by
+	// appendUpload, by upload id.
+	whappGo.uploads = {};
+
+	whappGo.appendUpload = function (uploadId, data) {
+		const bytes = Uint8Array.from(atob(data), c => c.charCodeAt(0));
+		if (whappGo.uploads[uploadId] == null) {
+			whappGo.uploads[uploadId] = [];
+		}
+		whappGo.uploads[uploadId].push(bytes);
+		return true;
+	};
+
+	whappGo.sendMedia = async function (id, uploadId, filename, mimetype, caption) {
+		id = idFromString(id);
+
+		const chunks = whappGo.uploads[uploadId];
+		delete whappGo.uploads[uploadId];
+		if (chunks == null) {
+			throw new Error('upload ' + uploadId + ' not found.');
+		}
+
+		const chat = Store.Chat.models.find(c => ideq(c.id, id));
+		if (chat == null) {
+			throw new Error('no chat with id ' + id + ' found.');
+		} else if (Store.MediaCollection == null) {
+			throw new Error('sending media is not supported.');
+		}
+
+		const file = new File(chunks, filename, { type: mimetype });
+
+		const mc = new Store.MediaCollection();
+		if (typeof mc.processAttachments === 'function') {
+			await mc.processAttachments([ { file } ], chat, 1);
+		} else {
+			await mc.processFiles([ file ], chat, 1);
+		}
+		const media = mc.models[0];
+		if (media == null) {
+			throw new Error('file could not be processed.');
+		}
+
+		const existing = new Set(chat.msgs.models);
+		await media.sendToChat(chat, { caption: caption });
+
+		return await whappGo.waitForSent(chat, existing, msg => msg.isMedia || msg.type === 'document');
+	};
+
+	whappGo.sendReaction = async function (msgID, reaction) {
+		if (Store.ReactionsSend == null) {
+			throw new Error('sending reactions is not supported.');
+		}
+
+		const msg = Store.Msg.get(msgID);
+		if (msg == null) {
+			throw new Error('no message with id ' + msgID + ' found.');
+		}
+
+		await Store.ReactionsSend.sendReactionToMsg(msg, reaction);
 	};
 
 	whappGo.getGroupParticipants = async function (id) {
@@ -300,6 +492,40 @@ func (wi *Instance) inject(ctx context.Context) error {
 			.map(whappGo.msgToJSON);
 	};
 
+	whappGo.sendSeen = async function (chatId) {
+		chatId = idFromString(chatId);
+
+		const chat = Store.Chat.models.find(c => ideq(c.id, chatId));
+		if (chat == null) {
+			throw new Error('no chat with id ' + chatId + ' found.');
+		}
+
+		if (typeof chat.sendSeen === 'function') {
+			await chat.sendSeen();
+		} else {
+			await Store.Wap.sendConversationSeen(chat.id, chat.lastReceivedKey, chat.unreadCount);
+		}
+	};
+
+	whappGo.sendChatState = async function (chatId, state) {
+		chatId = idFromString(chatId);
+
+		switch (state) {
+		case '` + ChatStateComposing + `':
+			await Store.Wap.sendChatstateComposing(chatId);
+			break;
+		case '` + ChatStateRecording + `':
+			await Store.Wap.sendChatstateRecording(chatId);
+			break;
+		case '` + ChatStatePaused + `':
+		case '` + ChatStateAvailable + `':
+			await Store.Wap.sendChatstatePaused(chatId);
+			break;
+		default:
+			throw new Error('unknown chat state ' + state);
+		}
+	};
+
 	whappGo.getCommonGroups = async function (contactId) {
 		contactId = idFromString(contactId);
 
@@ -334,6 +560,8 @@ func (wi *Instance) inject(ctx context.Context) error {
 	}
 	`
 
+	wi.installPush(ctx)
+
 	var idc []byte
 	if err := wi.cdp.Run(ctx, chromedp.Evaluate(script, &idc)); err != nil {
 		return err
@@ -346,6 +574,21 @@ func (wi *Instance) inject(ctx context.Context) error {
 		return err
 	}
 
+	if wi.pushing() != nil {
+		var ok bool
+		if err := wi.cdp.Run(
+			ctx,
+			chromedp.Evaluate("whappGo.setupPush()", &ok),
+		); err != nil || !ok {
+			log.Printf("error setting up push, falling back to polling: %v", err)
+			wi.mu.Lock()
+			wi.push = nil
+			wi.mu.Unlock()
+		}
+	}
+
+	wi.mu.Lock()
 	wi.injected = true
+	wi.mu.Unlock()
 	return nil
 }
@@ -0,0 +1,217 @@
+package whapp
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/chromedp/cdproto"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+)
+
+// pushBinding is the name of the function the injected script calls to push
+// events to us.
+const pushBinding = "whappGoPush"
+
+// maxPushBacklog is the maximum amount of pushed events queued for a single
+// listener, when a listener can't keep up the oldest events are dropped.
+const maxPushBacklog = 1000
+
+// The types of events pushed by the injected script.
+const (
+	pushMessage   = "message"
+	pushAck       = "ack"
+	pushLoggedIn  = "loggedIn"
+	pushReaction  = "reaction"
+	pushChatState = "chatState"
+)
+
+// pushEvent is the payload of a call to the push binding.
+type pushEvent struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Ack is a change in the acknowledgement state of a message, for example when
+// it has been delivered or read.
+type Ack struct {
+	ID  MessageID `json:"id"`
+	Ack int       `json:"ack"`
+}
+
+// Reaction is a reaction to a message, added or changed by the sender. An
+// empty Reaction means the sender removed their reaction.
+type Reaction struct {
+	MessageID string `json:"msgId"` // serialized ID of the message reacted to
+	SenderID  ID     `json:"senderId"`
+	Reaction  string `json:"reaction"`
+	Timestamp int64  `json:"t"`
+}
+
+// ChatState is a change in the chat state of a contact in a chat, for example
+// when they start typing.
+type ChatState struct {
+	ChatID   ID     `json:"chatId"`
+	SenderID ID     `json:"senderId"`
+	State    string `json:"state"`
+}
+
+// pushListener queues the pushed events of a single listener, so that a slow
+// listener doesn't hold up the others.
+type pushListener struct {
+	typ  string
+	ch   chan json.RawMessage
+	done <-chan struct{}
+
+	mu      sync.Mutex
+	queue   []json.RawMessage
+	pending chan struct{} // receives a value when an event has been queued
+}
+
+// pusher dispatches events pushed by the injected script to listeners.
+type pusher struct {
+	mu        sync.Mutex
+	listeners map[string][]*pushListener
+}
+
+// installPush adds the push binding to the page and starts dispatching its
+// calls. It's not an error when the binding can't be installed, in that case
+// the instance falls back to polling.
+func (wi *Instance) installPush(ctx context.Context) {
+	if wi.pushing() != nil {
+		return
+	}
+
+	if err := wi.cdp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context, h cdp.Executor) error {
+		return runtime.AddBinding(pushBinding).Do(ctx, h)
+	})); err != nil {
+		log.Printf("error installing push binding, falling back to polling: %s", err)
+		return
+	}
+
+	p := &pusher{
+		listeners: make(map[string][]*pushListener),
+	}
+	events := wi.cdp.Listen(cdproto.EventRuntimeBindingCalled)
+	go func() {
+		for ev := range events {
+			called, ok := ev.(*runtime.EventBindingCalled)
+			if !ok || called.Name != pushBinding {
+				continue
+			}
+
+			var event pushEvent
+			if err := json.Unmarshal([]byte(called.Payload), &event); err != nil {
+				log.Printf("error parsing pushed event: %s", err)
+				continue
+			}
+			p.dispatch(event)
+		}
+	}()
+
+	wi.mu.Lock()
+	wi.push = p
+	wi.mu.Unlock()
+}
+
+// pushing returns the pusher of the instance, or nil if push isn't available.
+// Whether or not push is available is only known after injecting.
+func (wi *Instance) pushing() *pusher {
+	wi.mu.Lock()
+	defer wi.mu.Unlock()
+
+	return wi.push
+}
+
+// listen returns a channel on which the data of all pushed events of the given
+// type is sent, until ctx is done.
+func (p *pusher) listen(ctx context.Context, typ string) <-chan json.RawMessage {
+	l := &pushListener{
+		typ:  typ,
+		ch:   make(chan json.RawMessage),
+		done: ctx.Done(),
+
+		pending: make(chan struct{}, 1),
+	}
+
+	p.mu.Lock()
+	p.listeners[typ] = append(p.listeners[typ], l)
+	p.mu.Unlock()
+
+	go l.run()
+	go func() {
+		<-ctx.Done()
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		listeners := p.listeners[typ]
+		for i, x := range listeners {
+			if x == l {
+				p.listeners[typ] = append(listeners[:i:i], listeners[i+1:]...)
+				break
+			}
+		}
+	}()
+
+	return l.ch
+}
+
+// dispatch queues the given event for all its listeners, without blocking.
+func (p *pusher) dispatch(event pushEvent) {
+	p.mu.Lock()
+	listeners := make([]*pushListener, len(p.listeners[event.Type]))
+	copy(listeners, p.listeners[event.Type])
+	p.mu.Unlock()
+
+	for _, l := range listeners {
+		l.push(event.Data)
+	}
+}
+
+// push queues the given event data.
+func (l *pushListener) push(data json.RawMessage) {
+	l.mu.Lock()
+	if len(l.queue) >= maxPushBacklog {
+		log.Printf("listener for pushed %s events can't keep up, dropping an event", l.typ)
+		l.queue = l.queue[1:]
+	}
+	l.queue = append(l.queue, data)
+	l.mu.Unlock()
+
+	select {
+	case l.pending <- struct{}{}:
+	default:
+	}
+}
+
+// run sends the queued events on the channel of the listener, until it's done.
+func (l *pushListener) run() {
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-l.pending:
+		}
+
+		for {
+			l.mu.Lock()
+			if len(l.queue) == 0 {
+				l.mu.Unlock()
+				break
+			}
+			data := l.queue[0]
+			l.queue = l.queue[1:]
+			l.mu.Unlock()
+
+			select {
+			case <-l.done:
+				return
+			case l.ch <- data:
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package whapp
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPushSlowListener(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := &pusher{listeners: make(map[string][]*pushListener)}
+	slow := p.listen(ctx, pushMessage)
+	acks := p.listen(ctx, pushAck)
+
+	// nobody reads from slow, which shouldn't block dispatching the ack.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			p.dispatch(pushEvent{Type: pushMessage, Data: json.RawMessage("{}")})
+		}
+		p.dispatch(pushEvent{Type: pushAck, Data: json.RawMessage("1")})
+	}()
+
+	select {
+	case data := <-acks:
+		if string(data) != "1" {
+			t.Errorf("expected ack 1, got %s", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dispatching blocked on a slow listener")
+	}
+	<-done
+
+	for i := 0; i < 10; i++ {
+		select {
+		case <-slow:
+		case <-time.After(time.Second):
+			t.Fatalf("expected 10 queued messages, got %d", i)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package whapp
+
+import (
+	"github.com/chromedp/cdproto"
+	"github.com/chromedp/cdproto/inspector"
+	"github.com/chromedp/cdproto/page"
+)
+
+// ResetReason describes why the state of an Instance has been lost.
+type ResetReason int
+
+const (
+	// ResetReload means WhatsApp Web has been reloaded, losing the injected
+	// script.
+	ResetReload ResetReason = iota
+	// ResetCrash means the chromium target crashed or has been detached, the
+	// Instance is unusable.
+	ResetCrash
+)
+
+func (r ResetReason) String() string {
+	switch r {
+	case ResetReload:
+		return "page reloaded"
+	case ResetCrash:
+		return "target crashed"
+	}
+	return "unknown"
+}
+
+// watchTarget listens for page reloads and crashes of the current Instance's
+// target, and notifies on the resets channel.
+func (wi *Instance) watchTarget() {
+	wi.resets = make(chan ResetReason, 1)
+
+	notify := func(reason ResetReason) {
+		select {
+		case wi.resets <- reason:
+		default:
+			// there's already a reset pending
+		}
+	}
+
+	events := wi.cdp.Listen(
+		cdproto.EventPageFrameNavigated,
+		cdproto.EventInspectorTargetCrashed,
+		cdproto.EventInspectorDetached,
+	)
+	go func() {
+		for ev := range events {
+			switch ev := ev.(type) {
+			case *page.EventFrameNavigated:
+				if ev.Frame == nil || ev.Frame.ParentID != "" {
+					continue // not the main frame
+				}
+
+				// the injected script is gone, but this is only a problem when
+				// we actually did inject it already.
+				wi.mu.Lock()
+				wasInjected := wi.injected
+				wi.injected = false
+				wi.mu.Unlock()
+				if wasInjected && wi.LoginState == Loggedin {
+					notify(ResetReload)
+				}
+
+			case *inspector.EventTargetCrashed, *inspector.EventDetached:
+				wi.mu.Lock()
+				wi.injected = false
+				wi.mu.Unlock()
+				notify(ResetCrash)
+			}
+		}
+	}()
+}
+
+// LoggedIn returns whether or not the user was logged in the last time the
+// login state has been checked.
+func (wi *Instance) LoggedIn() bool {
+	return wi.LoginState == Loggedin
+}
+
+// Resets returns a channel which receives a value when the state of the
+// current Instance has been lost, either because WhatsApp Web has been
+// reloaded or because chromium crashed.
+func (wi *Instance) Resets() <-chan ResetReason {
+	return wi.resets
+}
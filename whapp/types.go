@@ -2,14 +2,9 @@ package whapp
 
 import (
 	"context"
-	"fmt"
 	"regexp"
-	"sort"
-	"strconv"
 	"strings"
 	"time"
-
-	"github.com/chromedp/chromedp"
 )
 
 func resolveMentionsInString(body string, mentionedIDs []ID, participants []Participant, ownName string) string {
@@ -110,21 +105,8 @@ func (c Contact) GetName() string {
 
 // GetCommonGroups gets the groups both the logged-in user and the contact c are
 // in.
-func (c Contact) GetCommonGroups(ctx context.Context, wi *Instance) ([]Chat, error) {
-	var res []Chat
-
-	if wi.LoginState != Loggedin {
-		return res, ErrLoggedOut
-	}
-
-	if err := wi.inject(ctx); err != nil {
-		return res, err
-	}
-
-	str := fmt.Sprintf("whappGo.getCommonGroups(%s)", strconv.Quote(c.ID.String()))
-
-	err := wi.cdp.Run(ctx, chromedp.Evaluate(str, &res, awaitPromise))
-	return res, err
+func (c Contact) GetCommonGroups(ctx context.Context, b Backend) ([]Chat, error) {
+	return b.GetCommonGroups(ctx, c.ID)
 }
 
 // Participant represents a participants in a group chat.
@@ -169,6 +151,13 @@ type MediaData struct {
 	// Streamable  bool         `json:"streamable"`
 }
 
+// MediaFile is a file to be sent as a media message.
+type MediaFile struct {
+	Name     string
+	MimeType string
+	Bytes    []byte
+}
+
 // LocationData contains information specific to a location message.
 type LocationData struct {
 	Latitude   float64 `json:"latitude"`
@@ -387,120 +376,52 @@ func (c Chat) PinTime() (pinTime time.Time, set bool) {
 
 // Participants retrieves and returns a slice containing all participants of the
 // current group chat.
-func (c Chat) Participants(ctx context.Context, wi *Instance) ([]Participant, error) {
-	var res []Participant
-
+func (c Chat) Participants(ctx context.Context, b Backend) ([]Participant, error) {
 	if !c.IsGroupChat {
-		return res, nil
-	}
-
-	if wi.LoginState != Loggedin {
-		return res, ErrLoggedOut
-	}
-
-	if err := wi.inject(ctx); err != nil {
-		return res, err
+		return nil, nil
 	}
 
-	str := fmt.Sprintf("whappGo.getGroupParticipants(%s)", strconv.Quote(c.ID.String()))
-
-	err := wi.cdp.Run(ctx, chromedp.Evaluate(str, &res, awaitPromise))
-	if err != nil {
-		return res, err
-	}
-
-	return res, nil
+	return b.GetParticipants(ctx, c.ID)
 }
 
 // GetPresence retrieves and returns the presence of the current private chat.
-func (c Chat) GetPresence(ctx context.Context, wi *Instance) (Presence, error) {
-	// TODO REVIEW
-
-	var res Presence
-
-	if wi.LoginState != Loggedin {
-		return res, ErrLoggedOut
-	}
-
-	if err := wi.inject(ctx); err != nil {
-		return res, err
-	}
-
-	str := fmt.Sprintf("whappGo.getPresence(%s)", strconv.Quote(c.ID.String()))
-
-	err := wi.cdp.Run(ctx, chromedp.Evaluate(str, &res, awaitPromise))
-	if err != nil {
-		return res, err
-	}
-
-	return res, nil
+func (c Chat) GetPresence(ctx context.Context, b Backend) (Presence, error) {
+	return b.GetPresence(ctx, c.ID)
 }
 
 // SetAdmin sets the admin state of the user with given userID in the current
 // chat.
-func (c Chat) SetAdmin(ctx context.Context, wi *Instance, userID ID, setAdmin bool) error {
-	str := fmt.Sprintf(
-		"whappGo.setAdmin(%s, %s, %t)",
-		strconv.Quote(c.ID.String()),
-		strconv.Quote(userID.String()),
-		setAdmin,
-	)
-	return runLoggedinWithoutRes(ctx, wi, str, false) // TODO: true?
+func (c Chat) SetAdmin(ctx context.Context, b Backend, userID ID, setAdmin bool) error {
+	return b.SetAdmin(ctx, c.ID, userID, setAdmin)
 }
 
 // AddParticipant adds the user with the given userID to the current chat.
-func (c Chat) AddParticipant(ctx context.Context, wi *Instance, userID ID) error {
-	str := fmt.Sprintf(
-		"whappGo.addParticipant(%s, %s)",
-		strconv.Quote(c.ID.String()),
-		strconv.Quote(userID.String()),
-	)
-	return runLoggedinWithoutRes(ctx, wi, str, false) // TODO: true?
+func (c Chat) AddParticipant(ctx context.Context, b Backend, userID ID) error {
+	return b.AddParticipant(ctx, c.ID, userID)
 }
 
 // RemoveParticipant removes the user with the given userID from the current
 // chat.
-func (c Chat) RemoveParticipant(ctx context.Context, wi *Instance, userID ID) error {
-	str := fmt.Sprintf(
-		"whappGo.removeParticipant(%s, %s)",
-		strconv.Quote(c.ID.String()),
-		strconv.Quote(userID.String()),
-	)
-	return runLoggedinWithoutRes(ctx, wi, str, false) // TODO: true?
+func (c Chat) RemoveParticipant(ctx context.Context, b Backend, userID ID) error {
+	return b.RemoveParticipant(ctx, c.ID, userID)
+}
+
+// SendSeen marks all messages in the current chat as read.
+func (c Chat) SendSeen(ctx context.Context, b Backend) error {
+	return b.SendSeen(ctx, c.ID)
+}
+
+// SendChatState sets the chat state of the user in the current chat.
+func (c Chat) SendChatState(ctx context.Context, b Backend, state string) error {
+	return b.SendChatState(ctx, c.ID, state)
 }
 
 // GetMessagesFromChatTillDate returns messages in the current chat with a
 // timestamp equal to or greater than `timestamp`.
 func (c Chat) GetMessagesFromChatTillDate(
 	ctx context.Context,
-	wi *Instance,
+	b Backend,
 	timestamp int64,
 ) ([]Message, error) {
-	var res []Message
-
-	if wi.LoginState != Loggedin {
-		return res, ErrLoggedOut
-	}
-
-	if err := wi.inject(ctx); err != nil {
-		return res, err
-	}
-
-	str := fmt.Sprintf(
-		"whappGo.getMessagesFromChatTillDate(%s, %d)",
-		strconv.Quote(c.ID.String()),
-		timestamp,
-	)
-	if err := wi.cdp.Run(
-		ctx,
-		chromedp.Evaluate(str, &res, awaitPromise),
-	); err != nil {
-		return res, err
-	}
-
-	sort.SliceStable(res, func(i, j int) bool {
-		return res[i].Timestamp < res[j].Timestamp
-	})
-
-	return res, nil
+	return b.GetMessagesFromChatTillDate(ctx, c.ID, timestamp)
 }
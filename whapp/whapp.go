@@ -4,11 +4,14 @@ package whapp
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/chromedp/chromedp"
@@ -42,9 +45,15 @@ func (u *poolUnit) Shutdown(ctx context.Context, opts ...client.Option) error {
 type Instance struct {
 	LoginState LoginState
 
-	unit     internalUnit
-	cdp      *chromedp.CDP
+	unit   internalUnit
+	cdp    *chromedp.CDP
+	resets chan ResetReason
+
+	injectMu sync.Mutex // held while injecting
+
+	mu       sync.Mutex // protects injected and push
 	injected bool
+	push     *pusher // nil if push isn't available
 }
 
 func getOptions(headless bool) []runner.CommandLineOption {
@@ -83,13 +92,14 @@ func MakeInstance(
 		return nil, err
 	}
 
-	return &Instance{
+	wi := &Instance{
 		LoginState: Loggedout,
 
-		unit:     cdp,
-		cdp:      cdp,
-		injected: false,
-	}, nil
+		unit: cdp,
+		cdp:  cdp,
+	}
+	wi.watchTarget()
+	return wi, nil
 }
 
 // MakeInstanceWithPool makes a new Instance using the given pool.
@@ -106,13 +116,14 @@ func MakeInstanceWithPool(
 		return nil, err
 	}
 
-	return &Instance{
+	wi := &Instance{
 		LoginState: Loggedout,
 
-		unit:     &poolUnit{res},
-		cdp:      res.CDP(),
-		injected: false,
-	}, nil
+		unit: &poolUnit{res},
+		cdp:  res.CDP(),
+	}
+	wi.watchTarget()
+	return wi, nil
 }
 
 // Navigate opens a tab with WhatsApp Web, without checking the login state.
@@ -238,7 +249,8 @@ func (wi *Instance) getLoggedIn(ctx context.Context) (bool, error) {
 	return res, wi.cdp.Run(ctx, action)
 }
 
-// ListenLoggedIn listens for login state changes by polling it every
+// ListenLoggedIn listens for login state changes. Changes are pushed by the
+// injected script when possible, otherwise the state is polled every
 // `interval`.
 func (wi *Instance) ListenLoggedIn(ctx context.Context, interval time.Duration) (<-chan bool, <-chan error) {
 	errCh := make(chan error)
@@ -248,27 +260,41 @@ func (wi *Instance) ListenLoggedIn(ctx context.Context, interval time.Duration)
 		defer close(errCh)
 		defer close(resCh)
 
-		prev := false
-		first := true
+		// getLoggedIn injects the script, only after that we know whether
+		// or not push is available.
+		prev, err := wi.getLoggedIn(ctx)
+		if err != nil {
+			errCh <- err
+			return
+		}
+
+		p := wi.pushing()
+		if p == nil {
+			wi.pollLoggedIn(ctx, interval, prev, resCh, errCh)
+			return
+		}
 
+		pushed := p.listen(ctx, pushLoggedIn)
 		for {
 			select {
 			case <-ctx.Done():
 				return
 
-			case <-time.After(interval):
-				res, err := wi.getLoggedIn(ctx)
-				if err != nil {
+			case data := <-pushed:
+				var res bool
+				if err := json.Unmarshal(data, &res); err != nil {
 					errCh <- err
 					return
 				}
 
-				if res != prev && !first {
-					resCh <- res
+				if res != prev {
+					select {
+					case <-ctx.Done():
+						return
+					case resCh <- res:
+					}
 				}
-
 				prev = res
-				first = false
 			}
 		}
 	}()
@@ -276,6 +302,37 @@ func (wi *Instance) ListenLoggedIn(ctx context.Context, interval time.Duration)
 	return resCh, errCh
 }
 
+func (wi *Instance) pollLoggedIn(
+	ctx context.Context,
+	interval time.Duration,
+	prev bool,
+	resCh chan<- bool,
+	errCh chan<- error,
+) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-time.After(interval):
+			res, err := wi.getLoggedIn(ctx)
+			if err != nil {
+				errCh <- err
+				return
+			}
+
+			if res != prev {
+				select {
+				case <-ctx.Done():
+					return
+				case resCh <- res:
+				}
+			}
+			prev = res
+		}
+	}
+}
+
 func (wi *Instance) getNewMessages(ctx context.Context) ([]Message, error) {
 	var res []Message
 
@@ -301,7 +358,8 @@ func (wi *Instance) getNewMessages(ctx context.Context) ([]Message, error) {
 	return res, nil
 }
 
-// ListenForMessages listens for new messages by polling every `interval`.
+// ListenForMessages listens for new messages. Messages are pushed by the
+// injected script when possible, otherwise they are polled every `interval`.
 func (wi *Instance) ListenForMessages(ctx context.Context, interval time.Duration) (<-chan Message, <-chan error) {
 	errCh := make(chan error)
 	messageCh := make(chan Message)
@@ -310,20 +368,46 @@ func (wi *Instance) ListenForMessages(ctx context.Context, interval time.Duratio
 		defer close(errCh)
 		defer close(messageCh)
 
+		if wi.LoginState != Loggedin {
+			errCh <- ErrLoggedOut
+			return
+		}
+
+		if err := wi.inject(ctx); err != nil {
+			errCh <- err
+			return
+		}
+
+		p := wi.pushing()
+		if p == nil {
+			wi.pollMessages(ctx, interval, messageCh, errCh)
+			return
+		}
+
+		// start listening before enabling push, so that we don't miss any
+		// messages.
+		pushed := p.listen(ctx, pushMessage)
+		if err := runLoggedinWithoutRes(ctx, wi, "whappGo.enablePush()", false); err != nil {
+			errCh <- err
+			return
+		}
+
 		for {
 			select {
 			case <-ctx.Done():
 				return
 
-			case <-time.After(interval):
-				res, err := wi.getNewMessages(ctx)
-				if err != nil {
+			case data := <-pushed:
+				var msg Message
+				if err := json.Unmarshal(data, &msg); err != nil {
 					errCh <- err
 					return
 				}
 
-				for _, msg := range res {
-					messageCh <- msg
+				select {
+				case <-ctx.Done():
+					return
+				case messageCh <- msg:
 				}
 			}
 		}
@@ -332,15 +416,304 @@ func (wi *Instance) ListenForMessages(ctx context.Context, interval time.Duratio
 	return messageCh, errCh
 }
 
+func (wi *Instance) pollMessages(
+	ctx context.Context,
+	interval time.Duration,
+	messageCh chan<- Message,
+	errCh chan<- error,
+) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-time.After(interval):
+			res, err := wi.getNewMessages(ctx)
+			if err != nil {
+				errCh <- err
+				return
+			}
+
+			for _, msg := range res {
+				select {
+				case <-ctx.Done():
+					return
+				case messageCh <- msg:
+				}
+			}
+		}
+	}
+}
+
+// ListenForAcks listens for changes in the acknowledgement state of messages.
+// This is only supported when the injected script can push events, otherwise
+// ErrNoPush is returned on the error channel.
+func (wi *Instance) ListenForAcks(ctx context.Context) (<-chan Ack, <-chan error) {
+	errCh := make(chan error)
+	ackCh := make(chan Ack)
+
+	go func() {
+		defer close(errCh)
+		defer close(ackCh)
+
+		if wi.LoginState != Loggedin {
+			errCh <- ErrLoggedOut
+			return
+		}
+
+		if err := wi.inject(ctx); err != nil {
+			errCh <- err
+			return
+		}
+
+		p := wi.pushing()
+		if p == nil {
+			errCh <- ErrNoPush
+			return
+		}
+
+		pushed := p.listen(ctx, pushAck)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case data := <-pushed:
+				var ack Ack
+				if err := json.Unmarshal(data, &ack); err != nil {
+					errCh <- err
+					return
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case ackCh <- ack:
+				}
+			}
+		}
+	}()
+
+	return ackCh, errCh
+}
+
+// ListenForReactions listens for reactions to messages, both from the user and
+// from others. Like ListenForAcks this is only supported when the injected
+// script can push events, otherwise ErrNoPush is returned on the error
+// channel.
+func (wi *Instance) ListenForReactions(ctx context.Context) (<-chan Reaction, <-chan error) {
+	errCh := make(chan error)
+	reactionCh := make(chan Reaction)
+
+	go func() {
+		defer close(errCh)
+		defer close(reactionCh)
+
+		if wi.LoginState != Loggedin {
+			errCh <- ErrLoggedOut
+			return
+		}
+
+		if err := wi.inject(ctx); err != nil {
+			errCh <- err
+			return
+		}
+
+		p := wi.pushing()
+		if p == nil {
+			errCh <- ErrNoPush
+			return
+		}
+
+		pushed := p.listen(ctx, pushReaction)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case data := <-pushed:
+				var reaction Reaction
+				if err := json.Unmarshal(data, &reaction); err != nil {
+					errCh <- err
+					return
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case reactionCh <- reaction:
+				}
+			}
+		}
+	}()
+
+	return reactionCh, errCh
+}
+
+// ListenForChatStates listens for changes in the chat states of contacts, such
+// as them typing. Like ListenForAcks this is only supported when the injected
+// script can push events, otherwise ErrNoPush is returned on the error
+// channel.
+func (wi *Instance) ListenForChatStates(ctx context.Context) (<-chan ChatState, <-chan error) {
+	errCh := make(chan error)
+	stateCh := make(chan ChatState)
+
+	go func() {
+		defer close(errCh)
+		defer close(stateCh)
+
+		if wi.LoginState != Loggedin {
+			errCh <- ErrLoggedOut
+			return
+		}
+
+		if err := wi.inject(ctx); err != nil {
+			errCh <- err
+			return
+		}
+
+		p := wi.pushing()
+		if p == nil {
+			errCh <- ErrNoPush
+			return
+		}
+
+		pushed := p.listen(ctx, pushChatState)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case data := <-pushed:
+				var state ChatState
+				if err := json.Unmarshal(data, &state); err != nil {
+					errCh <- err
+					return
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case stateCh <- state:
+				}
+			}
+		}
+	}()
+
+	return stateCh, errCh
+}
+
 // SendMessageToChatID sends the given `message` to the chat with the given
-// `chatID`.
-func (wi *Instance) SendMessageToChatID(ctx context.Context, chatID ID, message string) error {
+// `chatID`, it returns the ID of the new message once WhatsApp Web has accepted
+// it.
+func (wi *Instance) SendMessageToChatID(ctx context.Context, chatID ID, message string) (MessageID, error) {
 	str := fmt.Sprintf(
 		"whappGo.sendMessage(%s, %s)",
 		strconv.Quote(chatID.String()),
 		strconv.Quote(message),
 	)
-	return runLoggedinWithoutRes(ctx, wi, str, false)
+	return wi.sendMessage(ctx, str)
+}
+
+// SendReplyToChatID sends the given text message to the chat with the given
+// ID, quoting the message with the given ID. Like SendMessageToChatID it
+// returns the ID of the new message.
+func (wi *Instance) SendReplyToChatID(
+	ctx context.Context,
+	chatID ID,
+	message string,
+	quotedID MessageID,
+) (MessageID, error) {
+	str := fmt.Sprintf(
+		"whappGo.sendMessage(%s, %s, %s)",
+		strconv.Quote(chatID.String()),
+		strconv.Quote(message),
+		strconv.Quote(quotedID.Serialized),
+	)
+	return wi.sendMessage(ctx, str)
+}
+
+// mediaChunkSize is the amount of bytes of a file sent to the page at once by
+// SendMediaToChatID.
+const mediaChunkSize = 512 * 1024
+
+// lastUploadID is the ID of the last file sent to the page by
+// SendMediaToChatID.
+var lastUploadID uint64
+
+// SendMediaToChatID sends the given file to the chat with the given ID as a
+// media message with the given caption, which may be empty. Like
+// SendMessageToChatID it returns the ID of the new message. The file is sent to
+// the page in chunks, so that no single call to the page gets too large.
+func (wi *Instance) SendMediaToChatID(
+	ctx context.Context,
+	chatID ID,
+	file MediaFile,
+	caption string,
+) (MessageID, error) {
+	if max := MaxFileSize(file.MimeType); int64(len(file.Bytes)) > max {
+		return MessageID{}, fmt.Errorf("file is larger than %d bytes", max)
+	}
+
+	uploadID := strconv.Quote(strconv.FormatUint(atomic.AddUint64(&lastUploadID, 1), 10))
+	for start := 0; start < len(file.Bytes); start += mediaChunkSize {
+		end := start + mediaChunkSize
+		if end > len(file.Bytes) {
+			end = len(file.Bytes)
+		}
+
+		str := fmt.Sprintf(
+			"whappGo.appendUpload(%s, %s)",
+			uploadID,
+			strconv.Quote(base64.StdEncoding.EncodeToString(file.Bytes[start:end])),
+		)
+		if err := runLoggedinWithoutRes(ctx, wi, str, false); err != nil {
+			// don't keep the partial file around in the page.
+			cleanupCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			runLoggedinWithoutRes(cleanupCtx, wi, "delete whappGo.uploads["+uploadID+"]", false)
+			cancel()
+
+			return MessageID{}, err
+		}
+	}
+
+	str := fmt.Sprintf(
+		"whappGo.sendMedia(%s, %s, %s, %s, %s)",
+		strconv.Quote(chatID.String()),
+		uploadID,
+		strconv.Quote(file.Name),
+		strconv.Quote(file.MimeType),
+		strconv.Quote(caption),
+	)
+	return wi.sendMessage(ctx, str)
+}
+
+// sendMessage runs the given call to whappGo.sendMessage and returns the ID of
+// the sent message.
+func (wi *Instance) sendMessage(ctx context.Context, code string) (MessageID, error) {
+	var res MessageID
+
+	if wi.LoginState != Loggedin {
+		return res, ErrLoggedOut
+	}
+
+	if err := wi.inject(ctx); err != nil {
+		return res, err
+	}
+
+	err := wi.cdp.Run(ctx, chromedp.Evaluate(code, &res, awaitPromise))
+	return res, err
+}
+
+// SendReaction reacts to the message with the given ID using the given emoji,
+// an empty reaction removes the current reaction of the user.
+func (wi *Instance) SendReaction(ctx context.Context, msgID MessageID, reaction string) error {
+	str := fmt.Sprintf(
+		"whappGo.sendReaction(%s, %s)",
+		strconv.Quote(msgID.Serialized),
+		strconv.Quote(reaction),
+	)
+	return runLoggedinWithoutRes(ctx, wi, str, true)
 }
 
 // GetAllChats returns a slice containing all the chats the user has
@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"path/filepath"
+	"strings"
+	"whapp-irc/files"
+	"whapp-irc/ircconnection"
 	"whapp-irc/maps"
 	"whapp-irc/types"
 	"whapp-irc/util"
@@ -35,7 +39,11 @@ func getMessageBody(msg whapp.Message, participants []types.Participant, me whap
 	case msg.IsMMS:
 		res := "--file--"
 		if f, has := fs.GetFileByHash(msg.MediaFileHash); has {
-			res = f.URL
+			url := fs.URL(f)
+			if f.Metadata.Thumbnail {
+				url = fs.PreviewURL(f)
+			}
+			res = url + " " + formatFileInfo(f.Metadata)
 		}
 
 		if msg.Caption != "" {
@@ -49,13 +57,27 @@ func getMessageBody(msg whapp.Message, participants []types.Participant, me whap
 	}
 }
 
-func downloadAndStoreMedia(msg whapp.Message) error {
+// formatFileInfo returns the name, if known, and the size of the file with the
+// given metadata, in parentheses.
+func formatFileInfo(meta files.Metadata) string {
+	size := util.FormatSize(meta.Size)
+	if meta.Filename == "" {
+		return "(" + size + ")"
+	}
+
+	name := strings.Join(strings.Fields(meta.Filename), " ")
+	return fmt.Sprintf("(%s, %s)", name, size)
+}
+
+// downloadAndStoreMedia downloads the media of the given message, if any, and
+// stores it on the file server as owned by the given user.
+func downloadAndStoreMedia(ctx context.Context, b whapp.Backend, owner string, msg whapp.Message) error {
 	if !msg.IsMMS {
 		return nil
 	}
 
 	if _, has := fs.GetFileByHash(msg.MediaFileHash); !has {
-		bytes, err := msg.DownloadMedia()
+		bytes, err := b.DownloadMedia(ctx, msg)
 		if err != nil {
 			return err
 		}
@@ -68,19 +90,44 @@ func downloadAndStoreMedia(msg whapp.Message) error {
 			}
 		}
 
-		if _, err := fs.AddBlob(
+		f, err := fs.AddBlob(
 			msg.MediaFileHash,
 			ext,
 			bytes,
-		); err != nil {
+			files.Metadata{
+				Owner:    owner,
+				Filename: msg.MediaFilename,
+				MimeType: msg.MimeType,
+			},
+		)
+		if err != nil {
 			return err
 		}
+
+		// use the preview embedded in the message when we couldn't make a
+		// thumbnail ourselves, for example for videos.
+		if preview := msg.MediaData.Preview.Base64; !f.Metadata.Thumbnail && preview != "" {
+			bytes, err := base64.StdEncoding.DecodeString(preview)
+			if err == nil {
+				_, err = fs.AddThumbnail(f, bytes)
+			}
+			if err != nil {
+				log.Printf("error while storing thumbnail of %s: %s", msg.MediaFileHash, err)
+			}
+		}
 	}
 
 	return nil
 }
 
-func (conn *Connection) handleWhappMessage(ctx context.Context, msg whapp.Message, fn MessageHandler) error {
+// handleWhappMessage handles the given WhatsApp message, sending it to the
+// given clients using fn.
+func (conn *Connection) handleWhappMessage(
+	ctx context.Context,
+	clients []*ircconnection.Connection,
+	msg whapp.Message,
+	fn MessageHandler,
+) error {
 	// HACK
 	if msg.Type == "e2e_notification" {
 		return nil
@@ -97,15 +144,25 @@ func (conn *Connection) handleWhappMessage(ctx context.Context, msg whapp.Messag
 	chat := item.Chat
 
 	if chat.IsGroupChat && !chat.Joined {
-		if err := conn.joinChat(item); err != nil {
+		if err := conn.joinChat(clients, item); err != nil {
 			return err
 		}
 	}
 
-	if chat.HasMessageID(msg.ID.Serialized) {
-		return nil // already handled
+	conn.mu.Lock()
+	handled := chat.HasMessageID(msg.ID.Serialized)
+	if !handled {
+		chat.AddMessageID(msg.ID.Serialized)
+	}
+	conn.mu.Unlock()
+	if handled {
+		return nil
+	}
+
+	conn.messages.Add(msg)
+	if msg.QuotedMessage != nil {
+		conn.messages.Add(*msg.QuotedMessage)
 	}
-	chat.AddMessageID(msg.ID.Serialized)
 
 	lastTimestamp, found := conn.timestampMap.Get(chat.ID)
 	if !found || msg.Timestamp > lastTimestamp {
@@ -116,39 +173,61 @@ func (conn *Connection) handleWhappMessage(ctx context.Context, msg whapp.Messag
 	if msg.IsSentByMeFromWeb {
 		return nil
 	} else if msg.IsNotification {
-		return conn.handleWhappNotification(item, msg)
+		return conn.handleWhappNotification(clients, item, msg)
+	}
+
+	if err := downloadAndStoreMedia(ctx, conn.WI, conn.nick, msg); err != nil {
+		return err
 	}
+	quoted, message := conn.formatWhappMessage(item, msg)
+
+	return eachClient(clients, func(irc *ircconnection.Connection) error {
+		if quoted != nil {
+			if err := fn(irc, *quoted); err != nil {
+				return err
+			}
+		}
+
+		return fn(irc, message)
+	})
+}
+
+// formatWhappMessage formats the given WhatsApp message in the given chat for
+// IRC, quoted is nil if msg isn't a reply. Media that hasn't been downloaded
+// is formatted as --file--.
+func (conn *Connection) formatWhappMessage(
+	item types.ChatListItem,
+	msg whapp.Message,
+) (quoted *Message, message Message) {
+	chat := item.Chat
 
 	sender := formatContact(*msg.Sender)
 	from := sender.SafeName()
 	if msg.IsSentByMe {
-		from = conn.irc.Nick()
+		from = conn.nick
 	}
 
 	var to string
 	if chat.IsGroupChat || msg.IsSentByMe {
 		to = item.Identifier
 	} else {
-		to = conn.irc.Nick()
-	}
-
-	if err := downloadAndStoreMedia(msg); err != nil {
-		return err
+		to = conn.nick
 	}
 
 	if msg.QuotedMessage != nil {
 		body := getMessageBody(*msg.QuotedMessage, chat.Participants, conn.me)
-		message := Message{from, to, body, true, &msg}
-		if err := fn(conn, message); err != nil {
-			return err
-		}
+		quoted = &Message{from, to, body, true, &msg}
 	}
 
 	body := getMessageBody(msg, chat.Participants, conn.me)
-	return fn(conn, Message{from, to, body, false, &msg})
+	return quoted, Message{from, to, body, false, &msg}
 }
 
-func (conn *Connection) handleWhappNotification(chatItem types.ChatListItem, msg whapp.Message) error {
+func (conn *Connection) handleWhappNotification(
+	clients []*ircconnection.Connection,
+	chatItem types.ChatListItem,
+	msg whapp.Message,
+) error {
 	chat := chatItem.Chat
 
 	if msg.Type != "gp2" && msg.Type != "call_log" {
@@ -176,16 +255,23 @@ func (conn *Connection) handleWhappNotification(chatItem types.ChatListItem, msg
 
 	var author string
 	if msg.From == conn.me.SelfID {
-		author = conn.irc.Nick()
+		author = conn.nick
 	} else {
 		author = findName(msg.From)
 	}
 
+	// write writes the given line to all clients.
+	write := func(str string) error {
+		return eachClient(clients, func(irc *ircconnection.Connection) error {
+			return irc.Write(msg.Time(), str)
+		})
+	}
+
 	for _, recipientID := range msg.RecipientIDs {
 		recipientSelf := recipientID == conn.me.SelfID
 		var recipient string
 		if recipientSelf {
-			recipient = conn.irc.Nick()
+			recipient = conn.nick
 		} else {
 			recipient = findName(recipientID)
 		}
@@ -202,29 +288,31 @@ func (conn *Connection) handleWhappNotification(chatItem types.ChatListItem, msg
 				break
 			}
 			str := fmt.Sprintf(":%s JOIN %s", recipient, chatItem.Identifier)
-			if err := conn.irc.Write(msg.Time(), str); err != nil {
+			if err := write(str); err != nil {
 				return err
 			}
 
 		case "leave":
 			str := fmt.Sprintf(":%s PART %s", recipient, chatItem.Identifier)
-			if err := conn.irc.Write(msg.Time(), str); err != nil {
+			if err := write(str); err != nil {
 				return err
 			}
 
 		case "remove":
 			str := fmt.Sprintf(":%s KICK %s %s", author, chatItem.Identifier, recipient)
-			if err := conn.irc.Write(msg.Time(), str); err != nil {
+			if err := write(str); err != nil {
 				return err
 			}
 
 		case "miss":
-			if err := conn.irc.PrivateMessage(
-				msg.Time(),
-				author,
-				chatItem.Identifier,
-				"-- missed call --",
-			); err != nil {
+			if err := eachClient(clients, func(irc *ircconnection.Connection) error {
+				return irc.PrivateMessage(
+					msg.Time(),
+					author,
+					chatItem.Identifier,
+					"-- missed call --",
+				)
+			}); err != nil {
 				return err
 			}
 